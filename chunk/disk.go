@@ -0,0 +1,295 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// shardLength is the length of the shard directory names (one hex encoded byte)
+const shardLength = 2
+
+// tempSuffix ends the temporary chunk files while they are written, they are renamed into
+// place once complete, so that a crash never leaves a partial chunk behind
+const tempSuffix = ".tmp"
+
+// checksumHeader starts the chunk files that are stored with a checksum, it is followed
+// by the MD5 checksum of the chunk
+var checksumHeader = []byte("PDCHUNK1")
+
+// checksumHeaderLength is the length of the header of chunk files stored with a checksum
+const checksumHeaderLength = 8 + md5.Size
+
+// DiskStorage is a size limited chunk storage on disk, with Verify the chunks are
+// stored with a checksum and chunks that don't match it are dropped on load
+type DiskStorage struct {
+	Path    string
+	MaxSize int64
+	Verify  bool
+	size    int64
+	sizes   map[string]int64
+	stack   *Stack
+	lock    sync.Mutex
+}
+
+// NewDiskStorage creates a new disk storage and indexes the already existing chunks
+func NewDiskStorage(path string, maxSize int64) (*DiskStorage, error) {
+	if err := os.MkdirAll(path, 0766); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not create chunk cache directory %v", path)
+	}
+
+	storage := DiskStorage{
+		Path:    path,
+		MaxSize: maxSize,
+		sizes:   make(map[string]int64),
+		stack:   NewStack(0),
+	}
+
+	files, err := storage.readChunks()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read chunk cache directory %v", path)
+	}
+
+	// the least recently accessed chunks are evicted first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		storage.stack.Push(file.Name())
+		storage.sizes[file.Name()] = file.Size()
+		storage.size += file.Size()
+	}
+	storage.evict()
+
+	return &storage, nil
+}
+
+// readChunks gets the chunk files of all shard directories, chunks of the flat
+// layout of older versions are moved into their shard directory
+func (s *DiskStorage) readChunks() ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(s.Path)
+	if nil != err {
+		return nil, err
+	}
+
+	chunks := make([]os.FileInfo, 0, len(entries))
+	migrated := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			if err := s.migrate(entry.Name()); nil != err {
+				Log.Debugf("%v", err)
+				Log.Warningf("Could not move chunk %v into its shard directory", entry.Name())
+				continue
+			}
+			migrated++
+			chunks = append(chunks, entry)
+			continue
+		}
+		if shardLength != len(entry.Name()) {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(s.Path, entry.Name()))
+		if nil != err {
+			return nil, err
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), tempSuffix) {
+				// left over by a crash while writing, the chunk is downloaded again
+				Log.Debugf("Deleting incomplete chunk %v", file.Name())
+				os.Remove(filepath.Join(s.Path, entry.Name(), file.Name()))
+				continue
+			}
+			if !file.IsDir() {
+				chunks = append(chunks, file)
+			}
+		}
+	}
+	if migrated > 0 {
+		Log.Infof("Moved %v chunks into shard directories", migrated)
+	}
+
+	return chunks, nil
+}
+
+// migrate moves a chunk of the flat layout into its shard directory
+func (s *DiskStorage) migrate(id string) error {
+	filename := s.filename(id)
+	if err := os.MkdirAll(filepath.Dir(filename), 0766); nil != err {
+		return err
+	}
+	return os.Rename(filepath.Join(s.Path, id), filename)
+}
+
+// Load loads a chunk from disk
+func (s *DiskStorage) Load(id string) []byte {
+	s.lock.Lock()
+	_, exists := s.sizes[id]
+	s.lock.Unlock()
+	if !exists {
+		return nil
+	}
+
+	filename := s.filename(id)
+	content, err := ioutil.ReadFile(filename)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil
+	}
+	chunk, err := s.checkChunk(content)
+	if nil != err {
+		Log.Warningf("Dropping chunk %v from disk, %v", id, err)
+		s.remove(id)
+		return nil
+	}
+
+	// track the access time so that the eviction order survives restarts
+	s.stack.Touch(id)
+	now := time.Now()
+	if err := os.Chtimes(filename, now, now); nil != err {
+		Log.Debugf("%v", err)
+	}
+
+	return chunk
+}
+
+// checkChunk gets the chunk of the file content, with Verify the checksum has to match
+// (chunks without checksum are only accepted without Verify)
+func (s *DiskStorage) checkChunk(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, checksumHeader) || len(content) < checksumHeaderLength {
+		if s.Verify {
+			return nil, fmt.Errorf("it has been stored without checksum")
+		}
+		return content, nil
+	}
+
+	chunk := content[checksumHeaderLength:]
+	if s.Verify {
+		if checksum := md5.Sum(chunk); !bytes.Equal(checksum[:], content[len(checksumHeader):checksumHeaderLength]) {
+			return nil, fmt.Errorf("the checksum doesn't match (corrupted file)")
+		}
+	}
+	return chunk, nil
+}
+
+// remove deletes a chunk from disk
+func (s *DiskStorage) remove(id string) {
+	if err := os.Remove(s.filename(id)); nil != err && !os.IsNotExist(err) {
+		Log.Debugf("%v", err)
+	}
+
+	s.lock.Lock()
+	if size, exists := s.sizes[id]; exists {
+		s.size -= size
+		delete(s.sizes, id)
+		s.stack.Remove(id)
+	}
+	s.lock.Unlock()
+}
+
+// Store stores a chunk on disk and evicts the least recently used chunks
+func (s *DiskStorage) Store(id string, bytes []byte) error {
+	filename := s.filename(id)
+	if err := os.MkdirAll(filepath.Dir(filename), 0766); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not create shard directory for chunk %v", id)
+	}
+	content := bytes
+	if s.Verify {
+		checksum := md5.Sum(bytes)
+		content = make([]byte, 0, checksumHeaderLength+len(bytes))
+		content = append(content, checksumHeader...)
+		content = append(content, checksum[:]...)
+		content = append(content, bytes...)
+	}
+	if err := writeFile(filename, content); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write chunk %v to disk", id)
+	}
+
+	s.lock.Lock()
+	if size, exists := s.sizes[id]; exists {
+		s.size -= size
+	} else {
+		s.stack.Push(id)
+	}
+	s.sizes[id] = int64(len(bytes))
+	s.size += int64(len(bytes))
+	s.evict()
+	s.lock.Unlock()
+
+	return nil
+}
+
+// writeFile writes the content to a unique temporary file in the directory of the chunk, syncs it
+// and renames it into place, so that an existing chunk file is always complete (even when the
+// same chunk is stored twice at once)
+func writeFile(filename string, content []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*"+tempSuffix)
+	if nil != err {
+		return err
+	}
+	temp := file.Name()
+	if err := file.Chmod(0644); nil != err {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+	if _, err := file.Write(content); nil != err {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := file.Sync(); nil != err {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := file.Close(); nil != err {
+		os.Remove(temp)
+		return err
+	}
+	if err := os.Rename(temp, filename); nil != err {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// evict deletes the least recently used chunks until the storage fits its maximum size
+func (s *DiskStorage) evict() {
+	for s.size > s.MaxSize {
+		id := s.stack.Pop()
+		if "" == id {
+			return
+		}
+
+		if err := os.Remove(s.filename(id)); nil != err && !os.IsNotExist(err) {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not delete chunk %v from disk", id)
+		}
+		s.size -= s.sizes[id]
+		delete(s.sizes, id)
+
+		Log.Debugf("Deleted chunk %v from disk", id)
+	}
+}
+
+// filename gets the path of the chunk, chunks are spread over 256 shard directories
+// (by the first byte of the hashed id) to keep the directories small
+func (s *DiskStorage) filename(id string) string {
+	hash := md5.Sum([]byte(id))
+	return filepath.Join(s.Path, hex.EncodeToString(hash[:1]), id)
+}
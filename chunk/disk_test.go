@@ -0,0 +1,270 @@
+package chunk
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dweidenfeld/plexdrive/drive"
+)
+
+func TestDiskEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-chunks")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := NewDiskStorage(dir, 8)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	storage.Store("1", []byte("1234"))
+	storage.Store("2", []byte("1234"))
+	storage.Load("1")
+	storage.Store("3", []byte("1234"))
+
+	if nil != storage.Load("2") {
+		t.Fatalf("Expected chunk 2 to be evicted")
+	}
+	if nil == storage.Load("1") || nil == storage.Load("3") {
+		t.Fatalf("Expected chunks 1 and 3 to be cached")
+	}
+	if _, err := os.Stat(storage.filename("2")); !os.IsNotExist(err) {
+		t.Fatalf("Expected chunk file 2 to be deleted")
+	}
+}
+
+func TestDiskIndexExistingChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-chunks")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := NewDiskStorage(dir, 8)
+	if nil != err {
+		t.Fatal(err)
+	}
+	storage.Store("1", []byte("1234"))
+
+	storage, err = NewDiskStorage(dir, 8)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if v := storage.Load("1"); "1234" != string(v) {
+		t.Fatalf("Expected 1234 got %v", string(v))
+	}
+}
+
+func TestDiskMigrateFlatLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-chunks")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "1"), []byte("1234"), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	storage, err := NewDiskStorage(dir, 8)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "1234" != string(storage.Load("1")) {
+		t.Fatalf("Expected the flat chunk to be indexed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the flat chunk to be moved")
+	}
+	if filepath.Dir(storage.filename("1")) == dir {
+		t.Fatalf("Expected the chunk to be stored in a shard directory")
+	}
+}
+
+func TestDiskVerifyCorruptedChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-chunks")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.WriteHeader(206)
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	disk, err := NewDiskStorage(dir, 1024)
+	if nil != err {
+		t.Fatal(err)
+	}
+	disk.Verify = true
+	object := &drive.APIObject{ObjectID: "1", Size: 10, DownloadURL: server.URL}
+	read := func() []byte {
+		downloader := newTestDownloader()
+		go func() {
+			for req := range downloader.queue {
+				downloader.download(http.DefaultClient, req)
+			}
+		}()
+		manager := Manager{
+			ChunkSize:   10,
+			downloader:  downloader,
+			storage:     NewStorage(10, 10, disk),
+			queue:       make(chan *QueueEntry, 10),
+			lastOffsets: make(map[string]int64),
+		}
+		downloader.storage = manager.storage
+		go manager.thread()
+
+		p := make([]byte, 10)
+		if _, err := manager.ReadAt(context.Background(), object, p, 0); nil != err {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	read()
+	filename := disk.filename((&Manager{ChunkSize: 10}).chunkID(object, 0))
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(filename); nil == err {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if nil != err {
+		t.Fatal(err)
+	}
+	content[len(content)-1] = 'x'
+	if err := ioutil.WriteFile(filename, content, 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	if p := read(); "0123456789" != string(p) || 2 != atomic.LoadInt32(&downloads) {
+		t.Fatalf("Expected the corrupted chunk to be downloaded again got %v after %v downloads", string(p), downloads)
+	}
+}
+
+func TestDiskIncompleteChunkIsDownloadedAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-chunks")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.WriteHeader(206)
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	// a crash while writing leaves the temporary file without the chunk file
+	object := &drive.APIObject{ObjectID: "1", Size: 10, DownloadURL: server.URL}
+	id := (&Manager{ChunkSize: 10}).chunkID(object, 0)
+	disk := &DiskStorage{Path: dir}
+	filename := disk.filename(id)
+	if err := os.MkdirAll(filepath.Dir(filename), 0766); nil != err {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename+tempSuffix, []byte("01234"), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	disk, err = NewDiskStorage(dir, 1024)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + tempSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Expected the incomplete chunk to be deleted")
+	}
+
+	downloader := newTestDownloader()
+	go func() {
+		for req := range downloader.queue {
+			downloader.download(http.DefaultClient, req)
+		}
+	}()
+	manager := Manager{
+		ChunkSize:   10,
+		downloader:  downloader,
+		storage:     NewStorage(10, 10, disk),
+		queue:       make(chan *QueueEntry, 10),
+		lastOffsets: make(map[string]int64),
+	}
+	downloader.storage = manager.storage
+	go manager.thread()
+
+	p := make([]byte, 10)
+	if _, err := manager.ReadAt(context.Background(), object, p, 0); nil != err {
+		t.Fatal(err)
+	}
+	if "0123456789" != string(p) || 1 != atomic.LoadInt32(&downloads) {
+		t.Fatalf("Expected the chunk to be downloaded again got %v (%v downloads)", string(p), downloads)
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(filename); nil == err {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if content, err := ioutil.ReadFile(filename); nil != err || "0123456789" != string(content) {
+		t.Fatalf("Expected the complete chunk to be stored got %v (%v)", string(content), err)
+	}
+}
+
+func TestDiskConcurrentStoresOfTheSameChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-chunks")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := NewDiskStorage(dir, 1024)
+	if nil != err {
+		t.Fatal(err)
+	}
+	content := []byte("0123456789")
+
+	var wg sync.WaitGroup
+	var failures int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := storage.Store("1", content); nil != err {
+					atomic.AddInt32(&failures, 1)
+				}
+				if chunk := storage.Load("1"); nil != chunk && string(content) != string(chunk) {
+					atomic.AddInt32(&failures, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if 0 != failures {
+		t.Fatalf("Expected all stores and loads of the chunk to be complete got %v failures", failures)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(storage.filename("1")))
+	if 1 != len(files) {
+		t.Fatalf("Expected no temporary files to be left got %v files", len(files))
+	}
+}
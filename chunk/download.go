@@ -1,6 +1,7 @@
 package chunk
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -10,24 +11,44 @@ import (
 
 	. "github.com/claudetech/loggo/default"
 	"github.com/dweidenfeld/plexdrive/drive"
+	"github.com/dweidenfeld/plexdrive/metrics"
+	"golang.org/x/time/rate"
 )
 
+// maxDownloadRetryDelay is the maximum time to wait between two attempts of a download
+const maxDownloadRetryDelay = 32 * time.Second
+
 // Downloader handles concurrent chunk downloads
 type Downloader struct {
 	Client    *drive.Client
 	queue     chan *Request
-	callbacks map[string][]DownloadCallback
+	downloads map[string]*download
+	limiter   *rate.Limiter
 	lock      sync.Mutex
+	// storage stores every downloaded chunk once, no matter how many requests are waiting for it
+	storage *Storage
 }
 
 type DownloadCallback func(error, []byte)
 
-// NewDownloader creates a new download manager
-func NewDownloader(threads int, client *drive.Client) (*Downloader, error) {
+// download is one running download that is shared by all requests for the same chunk,
+// it is only canceled when all waiting requests have been canceled
+type download struct {
+	callbacks []DownloadCallback
+	waiters   int
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// NewDownloader creates a new download manager, the speed limit (bytes per second,
+// 0 = unlimited) is shared by all downloads
+func NewDownloader(threads int, client *drive.Client, speedLimit int64) (*Downloader, error) {
 	manager := Downloader{
 		Client:    client,
 		queue:     make(chan *Request, 100),
-		callbacks: make(map[string][]DownloadCallback, 100),
+		downloads: make(map[string]*download, 100),
+		limiter:   newSpeedLimiter(speedLimit),
 	}
 
 	for i := 0; i < threads; i++ {
@@ -37,44 +58,116 @@ func NewDownloader(threads int, client *drive.Client) (*Downloader, error) {
 	return &manager, nil
 }
 
-// Download starts a new download request
+// Download starts a new download request or joins the running download of the same chunk,
+// a download that has been canceled (all requests left) but not finished yet is replaced
 func (d *Downloader) Download(req *Request, callback DownloadCallback) {
 	d.lock.Lock()
-	_, exists := d.callbacks[req.id]
-	d.callbacks[req.id] = append(d.callbacks[req.id], callback)
+	dl, exists := d.downloads[req.id]
+	if exists && nil != dl.ctx.Err() {
+		exists = false
+	}
 	if !exists {
-		d.queue <- req
+		ctx, cancel := context.WithCancel(context.Background())
+		dl = &download{
+			ctx:    ctx,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		d.downloads[req.id] = dl
 	}
+	dl.callbacks = append(dl.callbacks, callback)
+	dl.waiters++
 	d.lock.Unlock()
+
+	if nil != req.ctx.Done() {
+		go d.leaveOnCancel(req, dl)
+	}
+
+	if !exists {
+		shared := *req
+		shared.ctx = dl.ctx
+		shared.download = dl
+
+		// wait for a free slot in the queue, unless all requests have been canceled meanwhile
+		select {
+		case d.queue <- &shared:
+		case <-dl.ctx.Done():
+			d.finish(&shared, nil, dl.ctx.Err())
+		}
+	}
 }
 
+// leaveOnCancel removes a canceled request from the download and cancels
+// the download when nobody is waiting for it anymore
+func (d *Downloader) leaveOnCancel(req *Request, dl *download) {
+	select {
+	case <-req.ctx.Done():
+		d.lock.Lock()
+		dl.waiters--
+		if 0 == dl.waiters {
+			Log.Debugf("Canceling download %v, all requests have been canceled", req.id)
+			dl.cancel()
+		}
+		d.lock.Unlock()
+	case <-dl.done:
+	}
+}
+
+// thread downloads the queued requests, the number of threads limits
+// the number of concurrent downloads
 func (d *Downloader) thread() {
 	for {
 		req := <-d.queue
+		if err := req.ctx.Err(); nil != err {
+			d.finish(req, nil, err)
+			continue
+		}
 		d.download(d.Client.GetNativeClient(), req)
 	}
 }
 
 func (d *Downloader) download(client *http.Client, req *Request) {
 	Log.Debugf("Starting download %v (preload: %v)", req.id, req.preload)
-	bytes, err := downloadFromAPI(client, req, 0)
+	bytes, err := downloadFromAPI(client, req, d.limiter, 1)
+	d.finish(req, bytes, err)
+}
 
+// finish passes the result to all requests waiting for the download of the shared request,
+// the download is only removed if it hasn't been replaced meanwhile
+func (d *Downloader) finish(req *Request, bytes []byte, err error) {
+	id := req.id
+	dl := req.download
 	d.lock.Lock()
-	callbacks := d.callbacks[req.id]
-	for _, callback := range callbacks {
-		callback(err, bytes)
+	if d.downloads[id] == dl {
+		delete(d.downloads, id)
 	}
-	delete(d.callbacks, req.id)
 	d.lock.Unlock()
+
+	close(dl.done)
+	dl.cancel()
+	if nil == err && nil != d.storage {
+		if err := d.storage.Store(id, bytes); nil != err {
+			Log.Warningf("Could not store chunk %v", id)
+		}
+	}
+	for _, callback := range dl.callbacks {
+		callback(err, bytes)
+	}
 }
 
-func downloadFromAPI(client *http.Client, request *Request, delay int64) ([]byte, error) {
+// downloadFromAPI downloads the range of the request, throttled or failing downloads are
+// retried with an exponential backoff until drive.MaxAttempts is reached
+func downloadFromAPI(client *http.Client, request *Request, limiter *rate.Limiter, attempt int) ([]byte, error) {
 	// sleep if request is throttled
-	if delay > 0 {
-		time.Sleep(time.Duration(delay) * time.Second)
+	if attempt > 1 {
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-request.ctx.Done():
+			return nil, request.ctx.Err()
+		}
 	}
 
-	req, err := http.NewRequest("GET", request.object.DownloadURL, nil)
+	req, err := http.NewRequestWithContext(request.ctx, "GET", request.object.GetDownloadURL(), nil)
 	if nil != err {
 		Log.Debugf("%v", err)
 		return nil, fmt.Errorf("Could not create request object %v (%v) from API", request.object.ObjectID, request.object.Name)
@@ -84,55 +177,95 @@ func downloadFromAPI(client *http.Client, request *Request, delay int64) ([]byte
 
 	Log.Tracef("Sending HTTP Request %v", req)
 
+	metrics.APIRequests.WithLabelValues("download").Inc()
 	res, err := client.Do(req)
 	if nil != err {
 		Log.Debugf("%v", err)
 		return nil, fmt.Errorf("Could not request object %v (%v) from API", request.object.ObjectID, request.object.Name)
 	}
 	defer res.Body.Close()
-	reader := res.Body
+	reader := newThrottledReader(request.ctx, res.Body, limiter)
 
-	if res.StatusCode != 206 {
-		if res.StatusCode != 403 && res.StatusCode != 500 {
-			Log.Debugf("Request\n----------\n%v\n----------\n", req)
-			Log.Debugf("Response\n----------\n%v\n----------\n", res)
-			return nil, fmt.Errorf("Wrong status code %v for %v", res.StatusCode, request.object)
+	// exports don't support ranges, the requested range is cut out of the whole response
+	if res.StatusCode == 200 && "" != request.object.ExportMimeType {
+		bytes, err := ioutil.ReadAll(reader)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not read objects %v (%v) API response", request.object.ObjectID, request.object.Name)
 		}
-
-		// throttle requests
-		if delay > 8 {
-			return nil, fmt.Errorf("Maximum throttle interval has been reached")
+		metrics.BytesDownloaded.Add(float64(len(bytes)))
+		if request.offsetStart >= int64(len(bytes)) {
+			return []byte{}, nil
 		}
+		if request.offsetEnd > int64(len(bytes)) {
+			return bytes[request.offsetStart:], nil
+		}
+		return bytes[request.offsetStart:request.offsetEnd], nil
+	}
+
+	if res.StatusCode != 206 {
 		bytes, err := ioutil.ReadAll(reader)
 		if nil != err {
 			Log.Debugf("%v", err)
 			return nil, fmt.Errorf("Could not read body of error")
 		}
-		body := string(bytes)
-		if strings.Contains(body, "dailyLimitExceeded") ||
-			strings.Contains(body, "userRateLimitExceeded") ||
-			strings.Contains(body, "rateLimitExceeded") ||
-			strings.Contains(body, "backendError") ||
-			strings.Contains(body, "internalError") {
-			if 0 == delay {
-				delay = 1
-			} else {
-				delay = delay * 2
-			}
-			return downloadFromAPI(client, request, delay)
+
+		// return an error if the request can't succeed (e.g. not found or forbidden)
+		if !isRetryableStatus(res.StatusCode, string(bytes)) {
+			Log.Debugf("Request\n----------\n%v\n----------\n", req)
+			Log.Debugf("Response\n----------\n%v\n----------\n", res)
+			Log.Debugf("%v", string(bytes))
+			return nil, fmt.Errorf("Could not read object %v (%v) / StatusCode: %v",
+				request.object.ObjectID, request.object.Name, res.StatusCode)
 		}
 
-		// return an error if other error occurred
-		Log.Debugf("%v", body)
-		return nil, fmt.Errorf("Could not read object %v (%v) / StatusCode: %v",
-			request.object.ObjectID, request.object.Name, res.StatusCode)
+		if attempt >= drive.MaxAttempts {
+			Log.Warningf("Giving up download of object %v (%v) after %v attempts / StatusCode: %v",
+				request.object.ObjectID, request.object.Name, attempt, res.StatusCode)
+			return nil, fmt.Errorf("Could not read object %v (%v), maximum number of attempts has been reached",
+				request.object.ObjectID, request.object.Name)
+		}
+		return downloadFromAPI(client, request, limiter, attempt+1)
 	}
 
 	bytes, err := ioutil.ReadAll(reader)
+	metrics.BytesDownloaded.Add(float64(len(bytes)))
 	if nil != err {
 		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not read objects %v (%v) API response", request.object.ObjectID, request.object.Name)
+		if nil != request.ctx.Err() || attempt >= drive.MaxAttempts {
+			return nil, fmt.Errorf("Could not read objects %v (%v) API response", request.object.ObjectID, request.object.Name)
+		}
+
+		// request only the rest of the range when the connection dropped
+		Log.Infof("Download of object %v (%v) was interrupted after %v bytes, resuming",
+			request.object.ObjectID, request.object.Name, len(bytes))
+		resumed := *request
+		resumed.offsetStart += int64(len(bytes))
+		rest, err := downloadFromAPI(client, &resumed, limiter, attempt+1)
+		if nil != err {
+			return nil, err
+		}
+		return append(bytes, rest...), nil
 	}
 
 	return bytes, nil
 }
+
+// isRetryableStatus checks if the download failed because of a rate limit or a server error
+func isRetryableStatus(statusCode int, body string) bool {
+	if 429 == statusCode || statusCode >= 500 {
+		return true
+	}
+	return 403 == statusCode && (strings.Contains(body, "dailyLimitExceeded") ||
+		strings.Contains(body, "userRateLimitExceeded") ||
+		strings.Contains(body, "rateLimitExceeded"))
+}
+
+// retryDelay gets the time to wait before the attempt (1s, 2s, 4s, ... up to 32s)
+func retryDelay(attempt int) time.Duration {
+	delay := time.Second << uint(attempt-2)
+	if attempt > 7 || delay > maxDownloadRetryDelay {
+		delay = maxDownloadRetryDelay
+	}
+	return delay
+}
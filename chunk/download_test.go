@@ -0,0 +1,246 @@
+package chunk
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dweidenfeld/plexdrive/drive"
+)
+
+func newTestDownloader() *Downloader {
+	return &Downloader{
+		queue:     make(chan *Request, 10),
+		downloads: make(map[string]*download),
+	}
+}
+
+func newTestRequest(ctx context.Context, url string) *Request {
+	return &Request{
+		ctx:       ctx,
+		id:        "1:0:0",
+		object:    &drive.APIObject{ObjectID: "1", DownloadURL: url},
+		offsetEnd: 4,
+	}
+}
+
+func TestCanceledWaiterDoesNotCancelSharedDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(206)
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	downloader := newTestDownloader()
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan []byte, 2)
+	callback := func(err error, bytes []byte) {
+		if nil != err {
+			t.Errorf("Unexpected error %v", err)
+		}
+		results <- bytes
+	}
+
+	downloader.Download(newTestRequest(ctx, server.URL), callback)
+	downloader.Download(newTestRequest(context.Background(), server.URL), callback)
+	if 1 != len(downloader.queue) {
+		t.Fatalf("Expected one shared download got %v", len(downloader.queue))
+	}
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	req := <-downloader.queue
+	if nil != req.ctx.Err() {
+		t.Fatalf("Expected shared download not to be canceled")
+	}
+	downloader.download(http.DefaultClient, req)
+
+	for i := 0; i < 2; i++ {
+		if bytes := <-results; "data" != string(bytes) {
+			t.Fatalf("Expected data got %v", string(bytes))
+		}
+	}
+}
+
+func TestSharedDownloadIsCanceledWithoutWaiters(t *testing.T) {
+	downloader := newTestDownloader()
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	callback := func(err error, bytes []byte) {}
+
+	downloader.Download(newTestRequest(ctx1, ""), callback)
+	downloader.Download(newTestRequest(ctx2, ""), callback)
+	req := <-downloader.queue
+
+	cancel1()
+	time.Sleep(10 * time.Millisecond)
+	if nil != req.ctx.Err() {
+		t.Fatalf("Expected shared download not to be canceled while a request is waiting")
+	}
+
+	cancel2()
+	time.Sleep(10 * time.Millisecond)
+	if nil == req.ctx.Err() {
+		t.Fatalf("Expected shared download to be canceled")
+	}
+}
+
+func TestCanceledDownloadIsReplacedByNewRequest(t *testing.T) {
+	downloader := newTestDownloader()
+	ctx, cancel := context.WithCancel(context.Background())
+	downloader.Download(newTestRequest(ctx, ""), func(err error, bytes []byte) {})
+	canceled := <-downloader.queue
+
+	// the download is canceled but hasn't been finished by its thread yet
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if nil == canceled.ctx.Err() {
+		t.Fatalf("Expected the download to be canceled")
+	}
+
+	results := make(chan error, 1)
+	downloader.Download(newTestRequest(context.Background(), ""), func(err error, bytes []byte) {
+		results <- err
+	})
+	if 1 != len(downloader.queue) {
+		t.Fatalf("Expected a new download to be started")
+	}
+	req := <-downloader.queue
+	if nil != req.ctx.Err() {
+		t.Fatalf("Expected the new download not to be canceled")
+	}
+
+	// finishing the canceled download doesn't touch the new one
+	downloader.finish(canceled, nil, canceled.ctx.Err())
+	downloader.finish(req, []byte("data"), nil)
+	if err := <-results; nil != err {
+		t.Fatalf("Expected the new request to succeed got %v", err)
+	}
+}
+
+func TestCanceledRequestStopsWaitingForTheQueue(t *testing.T) {
+	downloader := &Downloader{
+		queue:     make(chan *Request),
+		downloads: make(map[string]*download),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan error, 1)
+
+	go downloader.Download(newTestRequest(ctx, ""), func(err error, bytes []byte) {
+		results <- err
+	})
+	cancel()
+
+	select {
+	case err := <-results:
+		if nil == err {
+			t.Fatalf("Expected an error for the canceled request")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the canceled request to stop waiting for the queue")
+	}
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	for _, test := range []struct {
+		statusCode int
+		body       string
+		expected   bool
+	}{
+		{429, "", true},
+		{500, "", true},
+		{503, "backendError", true},
+		{403, `{"error": {"errors": [{"reason": "userRateLimitExceeded"}]}}`, true},
+		{403, `{"error": {"errors": [{"reason": "forbidden"}]}}`, false},
+		{404, "", false},
+		{416, "", false},
+	} {
+		if actual := isRetryableStatus(test.statusCode, test.body); test.expected != actual {
+			t.Fatalf("Expected %v for status %v (%v) got %v", test.expected, test.statusCode, test.body, actual)
+		}
+	}
+}
+
+func TestDownloadGivesUpAfterMaxAttempts(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	maxAttempts := drive.MaxAttempts
+	drive.MaxAttempts = 1
+	defer func() { drive.MaxAttempts = maxAttempts }()
+
+	if _, err := downloadFromAPI(http.DefaultClient, newTestRequest(context.Background(), server.URL), nil, 1); nil == err {
+		t.Fatalf("Expected an error after the last attempt")
+	}
+	if 1 != requests {
+		t.Fatalf("Expected one request got %v", requests)
+	}
+}
+
+func TestDownloadResumesInterruptedRange(t *testing.T) {
+	ranges := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if 1 == len(ranges) {
+			// announce the whole range but drop the connection after two bytes
+			w.Header().Set("Content-Length", "4")
+			w.WriteHeader(206)
+			w.Write([]byte("da"))
+			return
+		}
+		w.WriteHeader(206)
+		w.Write([]byte("ta"))
+	}))
+	defer server.Close()
+
+	request := newTestRequest(context.Background(), server.URL)
+	bytes, err := downloadFromAPI(http.DefaultClient, request, nil, 1)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "data" != string(bytes) {
+		t.Fatalf("Expected data got %v", string(bytes))
+	}
+	if 2 != len(ranges) || "bytes=0-3" != ranges[0] || "bytes=2-3" != ranges[1] {
+		t.Fatalf("Expected the rest of the range to be requested got %v", ranges)
+	}
+	if 0 != request.offsetStart {
+		t.Fatalf("Expected the original request not to be changed")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestDownloadWithoutDownloadURL(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if "https://www.googleapis.com/drive/v3/files/1?alt=media" != r.URL.String() || "bytes=0-3" != r.Header.Get("Range") {
+			t.Fatalf("Expected a range request with alt=media got %v (%v)", r.URL, r.Header.Get("Range"))
+		}
+		return &http.Response{
+			StatusCode: 206,
+			Body:       ioutil.NopCloser(strings.NewReader("data")),
+			Request:    r,
+		}, nil
+	})}
+
+	bytes, err := downloadFromAPI(client, newTestRequest(context.Background(), ""), nil, 1)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "data" != string(bytes) {
+		t.Fatalf("Expected data got %v", string(bytes))
+	}
+}
@@ -1,7 +1,10 @@
 package chunk
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	. "github.com/claudetech/loggo/default"
 
@@ -10,13 +13,29 @@ import (
 	"github.com/dweidenfeld/plexdrive/drive"
 )
 
+// maxTrackedObjects is the number of objects whose last read offset is remembered
+const maxTrackedObjects = 1000
+
+const (
+	// MinChunkSize is the smallest allowed chunk size
+	MinChunkSize = 256 * 1024
+	// MaxChunkSize is the biggest allowed chunk size (chunks are held in memory as a whole)
+	MaxChunkSize = 1024 * 1024 * 1024
+	// ChunkSizeAlignment is the multiple chunk sizes are rounded up to (the read size of FUSE)
+	ChunkSizeAlignment = 128 * 1024
+)
+
 // Manager manages chunks on disk
 type Manager struct {
-	ChunkSize  int64
-	LoadAhead  int
-	downloader *Downloader
-	storage    *Storage
-	queue      chan *QueueEntry
+	ChunkSize       int64
+	LoadAhead       int
+	DedupChunks     bool
+	PreloadTimeout  time.Duration
+	downloader      *Downloader
+	storage         *Storage
+	queue           chan *QueueEntry
+	lastOffsets     map[string]int64
+	lastOffsetsLock sync.Mutex
 }
 
 type QueueEntry struct {
@@ -26,6 +45,7 @@ type QueueEntry struct {
 
 // Request represents a chunk request
 type Request struct {
+	ctx            context.Context
 	id             string
 	object         *drive.APIObject
 	offsetStart    int64
@@ -33,6 +53,16 @@ type Request struct {
 	chunkOffset    int64
 	chunkOffsetEnd int64
 	preload        bool
+	cancel         context.CancelFunc
+	// download is the shared download of a queued request
+	download *download
+}
+
+// release frees the timeout of a preload request when it has been answered
+func (r *Request) release() {
+	if nil != r.cancel {
+		r.cancel()
+	}
 }
 
 // Response represetns a chunk response
@@ -48,30 +78,52 @@ func NewManager(
 	checkThreads int,
 	loadThreads int,
 	client *drive.Client,
-	maxChunks int) (*Manager, error) {
+	maxChunks int,
+	diskCacheDir string,
+	diskCacheSize int64,
+	speedLimit int64,
+	dedupChunks bool,
+	verifyChunks bool,
+	preloadTimeout time.Duration) (*Manager, error) {
 
-	if chunkSize < 4096 {
-		return nil, fmt.Errorf("Chunk size must not be < 4096")
-	}
-	if chunkSize%1024 != 0 {
-		return nil, fmt.Errorf("Chunk size must be divideable by 1024")
+	chunkSize, err := ValidateChunkSize(chunkSize)
+	if nil != err {
+		return nil, err
 	}
+	Log.Infof("Using a chunk size of %v bytes", chunkSize)
+
 	if maxChunks < 2 || maxChunks < loadAhead {
 		return nil, fmt.Errorf("max-chunks must be greater than 2 and bigger than the load ahead value")
 	}
 
-	downloader, err := NewDownloader(loadThreads, client)
+	downloader, err := NewDownloader(loadThreads, client, speedLimit)
 	if nil != err {
 		return nil, err
 	}
 
+	var disk *DiskStorage
+	if diskCacheSize > 0 {
+		if diskCacheSize < chunkSize {
+			return nil, fmt.Errorf("chunk-cache-size must not be smaller than the chunk size")
+		}
+		disk, err = NewDiskStorage(diskCacheDir, diskCacheSize)
+		if nil != err {
+			return nil, err
+		}
+		disk.Verify = verifyChunks
+	}
+
 	manager := Manager{
-		ChunkSize:  chunkSize,
-		LoadAhead:  loadAhead,
-		downloader: downloader,
-		storage:    NewStorage(chunkSize, maxChunks),
-		queue:      make(chan *QueueEntry, 100),
+		ChunkSize:      chunkSize,
+		LoadAhead:      loadAhead,
+		DedupChunks:    dedupChunks,
+		PreloadTimeout: preloadTimeout,
+		downloader:     downloader,
+		storage:        NewStorage(chunkSize, maxChunks, disk),
+		queue:          make(chan *QueueEntry, 100),
+		lastOffsets:    make(map[string]int64, maxTrackedObjects),
 	}
+	downloader.storage = manager.storage
 
 	if err := manager.storage.Clear(); nil != err {
 		return nil, err
@@ -84,14 +136,16 @@ func NewManager(
 	return &manager, nil
 }
 
-// GetChunk loads one chunk and starts the preload for the next chunks
-func (m *Manager) GetChunk(object *drive.APIObject, offset, size int64, response chan Response) {
+// GetChunk loads one chunk and starts the preload for the next chunks,
+// the download of the chunk is aborted as soon as ctx is done
+func (m *Manager) GetChunk(ctx context.Context, object *drive.APIObject, offset, size int64, response chan Response) {
 	chunkOffset := offset % m.ChunkSize
 	offsetStart := offset - chunkOffset
 	offsetEnd := offsetStart + m.ChunkSize
-	id := fmt.Sprintf("%v:%v", object.ObjectID, offsetStart)
+	id := m.chunkID(object, offsetStart)
 
 	request := &Request{
+		ctx:            ctx,
 		id:             id,
 		object:         object,
 		offsetStart:    offsetStart,
@@ -106,18 +160,30 @@ func (m *Manager) GetChunk(object *drive.APIObject, offset, size int64, response
 		response: response,
 	}
 
+	// don't preload on the first read, random or backward seeks, the chunks would probably
+	// never be read (players read the head and then seek to the index at the end of a file)
+	if !m.isSequential(object.ObjectID, offsetStart) {
+		Log.Tracef("Non sequential read of %v at %v, skipping preload", object.ObjectID, offsetStart)
+		return
+	}
+
 	for i := m.ChunkSize; i < (m.ChunkSize * int64(m.LoadAhead+1)); i += m.ChunkSize {
 		aheadOffsetStart := offsetStart + i
 		aheadOffsetEnd := aheadOffsetStart + m.ChunkSize
 		if uint64(aheadOffsetStart) < object.Size && uint64(aheadOffsetEnd) < object.Size {
-			id := fmt.Sprintf("%v:%v", object.ObjectID, aheadOffsetStart)
+			id := m.chunkID(object, aheadOffsetStart)
 			request := &Request{
+				ctx:         context.Background(),
 				id:          id,
 				object:      object,
 				offsetStart: aheadOffsetStart,
 				offsetEnd:   aheadOffsetEnd,
 				preload:     true,
 			}
+			// slow preloads are dropped, playback has probably moved on meanwhile
+			if m.PreloadTimeout > 0 {
+				request.ctx, request.cancel = context.WithTimeout(context.Background(), m.PreloadTimeout)
+			}
 			m.queue <- &QueueEntry{
 				request: request,
 			}
@@ -125,6 +191,87 @@ func (m *Manager) GetChunk(object *drive.APIObject, offset, size int64, response
 	}
 }
 
+// ReadAt reads len(p) bytes at offset into p, reads spanning multiple chunks are stitched
+// together from all chunks covering the range (the read stops at the end of the object)
+func (m *Manager) ReadAt(ctx context.Context, object *drive.APIObject, p []byte, offset int64) (int, error) {
+	end := offset + int64(len(p))
+	if object.Size > 0 && uint64(end) > object.Size {
+		end = int64(object.Size)
+	}
+
+	n := 0
+	for offset+int64(n) < end {
+		chunkStart := offset + int64(n)
+		chunkEnd := (chunkStart/m.ChunkSize + 1) * m.ChunkSize
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+
+		response := make(chan Response, 1)
+		m.GetChunk(ctx, object, chunkStart, chunkEnd-chunkStart, response)
+
+		var res Response
+		select {
+		case res = <-response:
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+		if nil != res.Error {
+			return n, res.Error
+		}
+
+		n += copy(p[n:], res.Bytes)
+		if int64(len(res.Bytes)) < chunkEnd-chunkStart {
+			// the object is shorter than expected
+			break
+		}
+	}
+
+	return n, nil
+}
+
+// isSequential checks if the chunk continues the previous read of the object,
+// the first read of an object is not sequential
+func (m *Manager) isSequential(objectID string, offsetStart int64) bool {
+	m.lastOffsetsLock.Lock()
+	defer m.lastOffsetsLock.Unlock()
+
+	last, exists := m.lastOffsets[objectID]
+	if !exists && len(m.lastOffsets) >= maxTrackedObjects {
+		m.lastOffsets = make(map[string]int64, maxTrackedObjects)
+	}
+	m.lastOffsets[objectID] = offsetStart
+
+	return exists && (offsetStart == last || offsetStart == last+m.ChunkSize)
+}
+
+// ValidateChunkSize checks the range of the chunk size and rounds it up to a multiple of
+// ChunkSizeAlignment, so that aligned reads of the kernel never span two chunks
+func ValidateChunkSize(chunkSize int64) (int64, error) {
+	if chunkSize < MinChunkSize {
+		return 0, fmt.Errorf("Chunk size must not be smaller than %v bytes", MinChunkSize)
+	}
+	if chunkSize > MaxChunkSize {
+		return 0, fmt.Errorf("Chunk size must not be bigger than %v bytes", MaxChunkSize)
+	}
+	if aligned := (chunkSize + ChunkSizeAlignment - 1) / ChunkSizeAlignment * ChunkSizeAlignment; aligned != chunkSize {
+		Log.Warningf("Chunk size %v is not a multiple of %v bytes, using %v instead", chunkSize, ChunkSizeAlignment, aligned)
+		chunkSize = aligned
+	}
+	return chunkSize, nil
+}
+
+// chunkID builds the id of a chunk, the modification time makes sure that
+// cached chunks of a changed file are not reused and the chunk size that chunks
+// on disk are not reused after the chunk size changed, with DedupChunks files with
+// the same checksum share their chunks (files without checksum keep their own chunks)
+func (m *Manager) chunkID(object *drive.APIObject, offset int64) string {
+	if m.DedupChunks && "" != object.MD5 && "" == object.ExportMimeType {
+		return fmt.Sprintf("md5-%v:%v:%v", object.MD5, m.ChunkSize, offset)
+	}
+	return fmt.Sprintf("%v:%v:%v:%v", object.ObjectID, object.LastModified.Unix(), m.ChunkSize, offset)
+}
+
 func (m *Manager) thread() {
 	for {
 		queueEntry := <-m.queue
@@ -133,7 +280,19 @@ func (m *Manager) thread() {
 }
 
 func (m *Manager) checkChunk(req *Request, response chan Response) {
+	if err := req.ctx.Err(); nil != err {
+		req.release()
+		if nil != response {
+			response <- Response{
+				Error: err,
+			}
+			close(response)
+		}
+		return
+	}
+
 	if bytes := m.storage.Load(req.id); nil != bytes {
+		req.release()
 		if nil != response {
 			response <- Response{
 				Bytes: adjustResponseChunk(req, bytes),
@@ -144,6 +303,7 @@ func (m *Manager) checkChunk(req *Request, response chan Response) {
 	}
 
 	m.downloader.Download(req, func(err error, bytes []byte) {
+		req.release()
 		if nil != err {
 			if nil != response {
 				response <- Response{
@@ -155,16 +315,11 @@ func (m *Manager) checkChunk(req *Request, response chan Response) {
 		}
 
 		if nil != response {
-
 			response <- Response{
 				Bytes: adjustResponseChunk(req, bytes),
 			}
 			close(response)
 		}
-
-		if err := m.storage.Store(req.id, bytes); nil != err {
-			Log.Warningf("Coult not store chunk %v", req.id)
-		}
 	})
 }
 
@@ -0,0 +1,255 @@
+package chunk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dweidenfeld/plexdrive/drive"
+)
+
+func TestSequentialReads(t *testing.T) {
+	manager := Manager{
+		ChunkSize:   10,
+		lastOffsets: make(map[string]int64),
+	}
+
+	if manager.isSequential("1", 0) {
+		t.Fatalf("Expected first read not to be sequential")
+	}
+	if !manager.isSequential("1", 0) {
+		t.Fatalf("Expected read of the same chunk to be sequential")
+	}
+	if !manager.isSequential("1", 10) {
+		t.Fatalf("Expected read of the next chunk to be sequential")
+	}
+	if manager.isSequential("1", 100) {
+		t.Fatalf("Expected forward seek not to be sequential")
+	}
+	if manager.isSequential("1", 20) {
+		t.Fatalf("Expected backward seek not to be sequential")
+	}
+	if manager.isSequential("2", 50) {
+		t.Fatalf("Expected first read of another object not to be sequential")
+	}
+}
+
+func TestValidateChunkSize(t *testing.T) {
+	for size, expected := range map[int64]int64{
+		10 * 1024 * 1024: 10 * 1024 * 1024,
+		1000 * 1000:      1024 * 1024,
+		MinChunkSize:     MinChunkSize,
+		MinChunkSize + 1: MinChunkSize + ChunkSizeAlignment,
+		MaxChunkSize:     MaxChunkSize,
+	} {
+		if actual, err := ValidateChunkSize(size); nil != err || expected != actual {
+			t.Fatalf("Expected chunk size %v for %v got %v (%v)", expected, size, actual, err)
+		}
+	}
+
+	for _, size := range []int64{4096, MinChunkSize - 1, MaxChunkSize + 1} {
+		if _, err := ValidateChunkSize(size); nil == err {
+			t.Fatalf("Expected chunk size %v to be rejected", size)
+		}
+	}
+}
+
+func TestReadAtAcrossChunks(t *testing.T) {
+	manager := Manager{
+		ChunkSize:   10,
+		storage:     NewStorage(10, 10, nil),
+		queue:       make(chan *QueueEntry, 10),
+		lastOffsets: make(map[string]int64),
+	}
+	go manager.thread()
+
+	object := &drive.APIObject{ObjectID: "1", Size: 35}
+	content := make([]byte, object.Size)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	for offset := int64(0); offset < int64(object.Size); offset += manager.ChunkSize {
+		end := offset + manager.ChunkSize
+		if end > int64(object.Size) {
+			end = int64(object.Size)
+		}
+		manager.storage.Store(manager.chunkID(object, offset), content[offset:end])
+	}
+
+	for _, read := range []struct {
+		offset, size, expected int64
+	}{
+		{2, 5, 5},   // inside one chunk
+		{5, 10, 10}, // crossing one boundary
+		{8, 15, 15}, // crossing two boundaries
+		{0, 35, 35}, // the whole object
+		{28, 10, 7}, // the final partial chunk
+		{35, 10, 0}, // at the end of the object
+	} {
+		p := make([]byte, read.size)
+		n, err := manager.ReadAt(context.Background(), object, p, read.offset)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if read.expected != int64(n) {
+			t.Fatalf("Expected %v bytes at %v got %v", read.expected, read.offset, n)
+		}
+		for i := 0; i < n; i++ {
+			if byte(read.offset)+byte(i) != p[i] {
+				t.Fatalf("Wrong byte %v at offset %v", p[i], read.offset+int64(i))
+			}
+		}
+	}
+}
+
+func TestSeekToTailOnlyLoadsRequestedChunks(t *testing.T) {
+	var lock sync.Mutex
+	ranges := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		lock.Unlock()
+		w.WriteHeader(206)
+		w.Write(make([]byte, 4096))
+	}))
+	defer server.Close()
+
+	downloader := newTestDownloader()
+	go func() {
+		for req := range downloader.queue {
+			downloader.download(http.DefaultClient, req)
+		}
+	}()
+	manager := Manager{
+		ChunkSize:   4096,
+		LoadAhead:   3,
+		downloader:  downloader,
+		storage:     NewStorage(4096, 10, nil),
+		queue:       make(chan *QueueEntry, 10),
+		lastOffsets: make(map[string]int64),
+	}
+	go manager.thread()
+
+	object := &drive.APIObject{ObjectID: "1", Size: 10 * 4096, DownloadURL: server.URL}
+	for _, offset := range []int64{0, int64(object.Size) - 1024} {
+		if _, err := manager.ReadAt(context.Background(), object, make([]byte, 1024), offset); nil != err {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if 2 != len(ranges) || "bytes=0-4095" != ranges[0] || "bytes=36864-40959" != ranges[1] {
+		t.Fatalf("Expected only the head and the tail chunk to be downloaded got %v", ranges)
+	}
+}
+
+func TestPreloadTimeoutDropsSlowPreloads(t *testing.T) {
+	var slow, canceled int32 = 1, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "bytes=0-4095" != r.Header.Get("Range") && 1 == atomic.LoadInt32(&slow) {
+			<-r.Context().Done()
+			atomic.AddInt32(&canceled, 1)
+			return
+		}
+		w.WriteHeader(206)
+		w.Write(make([]byte, 4096))
+	}))
+	defer server.Close()
+
+	downloader := newTestDownloader()
+	go func() {
+		for req := range downloader.queue {
+			downloader.download(http.DefaultClient, req)
+		}
+	}()
+	manager := Manager{
+		ChunkSize:      4096,
+		LoadAhead:      1,
+		PreloadTimeout: 20 * time.Millisecond,
+		downloader:     downloader,
+		storage:        NewStorage(4096, 10, nil),
+		queue:          make(chan *QueueEntry, 10),
+		lastOffsets:    make(map[string]int64),
+	}
+	downloader.storage = manager.storage
+	go manager.thread()
+
+	object := &drive.APIObject{ObjectID: "1", Size: 3 * 4096, DownloadURL: server.URL}
+	for _, offset := range []int64{0, 1024} {
+		if _, err := manager.ReadAt(context.Background(), object, make([]byte, 1024), offset); nil != err {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if 1 != atomic.LoadInt32(&canceled) {
+		t.Fatalf("Expected the slow preload to be canceled")
+	}
+	if nil != manager.storage.Load(manager.chunkID(object, 4096)) {
+		t.Fatalf("Expected the canceled preload not to be stored")
+	}
+
+	atomic.StoreInt32(&slow, 0)
+	if _, err := manager.ReadAt(context.Background(), object, make([]byte, 1024), 4096); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	manager := Manager{
+		ChunkSize:   10,
+		storage:     NewStorage(10, 10, nil),
+		queue:       make(chan *QueueEntry, 10),
+		lastOffsets: make(map[string]int64),
+	}
+	go manager.thread()
+
+	content := []byte("the content of a file in four chunks")
+	object := &drive.APIObject{ObjectID: "1", Size: uint64(len(content)), MD5: "ff54321b65b482cf5811a86863bacf35"}
+	for offset := int64(0); offset < int64(object.Size); offset += manager.ChunkSize {
+		end := offset + manager.ChunkSize
+		if end > int64(object.Size) {
+			end = int64(object.Size)
+		}
+		manager.storage.Store(manager.chunkID(object, offset), content[offset:end])
+	}
+
+	verification, err := manager.Verify(context.Background(), object)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !verification.Matches() || int64(len(content)) != verification.Size {
+		t.Fatalf("Expected checksum %v got %v (%v bytes)", object.MD5, verification.MD5, verification.Size)
+	}
+
+	if _, err := manager.Verify(context.Background(), &drive.APIObject{ObjectID: "2", Name: "doc"}); nil == err {
+		t.Fatalf("Expected objects without checksum to be rejected")
+	}
+}
+
+func TestDedupChunkID(t *testing.T) {
+	manager := Manager{ChunkSize: 10, DedupChunks: true}
+
+	first := &drive.APIObject{ObjectID: "1", MD5: "ff54321b65b482cf5811a86863bacf35", LastModified: time.Unix(1, 0)}
+	duplicate := &drive.APIObject{ObjectID: "2", MD5: "ff54321b65b482cf5811a86863bacf35", LastModified: time.Unix(2, 0)}
+	if manager.chunkID(first, 10) != manager.chunkID(duplicate, 10) {
+		t.Fatalf("Expected files with the same checksum to share their chunks")
+	}
+	if manager.chunkID(first, 0) == manager.chunkID(first, 10) {
+		t.Fatalf("Expected chunks at different offsets to have different ids")
+	}
+	if manager.chunkID(&drive.APIObject{ObjectID: "3"}, 0) == manager.chunkID(&drive.APIObject{ObjectID: "4"}, 0) {
+		t.Fatalf("Expected files without checksum to keep their own chunks")
+	}
+
+	manager.DedupChunks = false
+	if manager.chunkID(first, 10) == manager.chunkID(duplicate, 10) {
+		t.Fatalf("Expected files to keep their own chunks without dedup")
+	}
+}
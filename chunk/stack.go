@@ -55,6 +55,17 @@ func (s *Stack) Touch(id string) {
 	s.lock.Unlock()
 }
 
+// Remove removes the item from the stack
+func (s *Stack) Remove(id string) {
+	s.lock.Lock()
+	if item, exists := s.index[id]; exists {
+		s.items.Remove(item)
+		delete(s.index, id)
+		s.len--
+	}
+	s.lock.Unlock()
+}
+
 // Push adds a new item to the last position of the stack
 func (s *Stack) Push(id string) {
 	s.lock.Lock()
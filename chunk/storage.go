@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	. "github.com/claudetech/loggo/default"
+	"github.com/dweidenfeld/plexdrive/metrics"
 )
 
 // ErrTimeout is a timeout error
@@ -16,6 +17,7 @@ type Storage struct {
 	MaxChunks int
 	chunks    map[string][]byte
 	stack     *Stack
+	disk      *DiskStorage
 	lock      sync.Mutex
 }
 
@@ -25,13 +27,14 @@ type Item struct {
 	bytes []byte
 }
 
-// NewStorage creates a new storage
-func NewStorage(chunkSize int64, maxChunks int) *Storage {
+// NewStorage creates a new storage (disk may be nil to keep chunks in RAM only)
+func NewStorage(chunkSize int64, maxChunks int, disk *DiskStorage) *Storage {
 	storage := Storage{
 		ChunkSize: chunkSize,
 		MaxChunks: maxChunks,
 		chunks:    make(map[string][]byte),
 		stack:     NewStack(maxChunks),
+		disk:      disk,
 	}
 
 	return &storage
@@ -48,14 +51,43 @@ func (s *Storage) Load(id string) []byte {
 	if chunk, exists := s.chunks[id]; exists {
 		s.lock.Unlock()
 		s.stack.Touch(id)
+		metrics.ChunkCacheHits.WithLabelValues("memory").Inc()
 		return chunk
 	}
 	s.lock.Unlock()
-	return nil
+
+	if nil == s.disk {
+		metrics.ChunkCacheMisses.Inc()
+		return nil
+	}
+
+	// keep chunks loaded from disk in RAM, so that repeated reads don't touch the disk again
+	chunk := s.disk.Load(id)
+	if nil == chunk {
+		metrics.ChunkCacheMisses.Inc()
+		return nil
+	}
+	metrics.ChunkCacheHits.WithLabelValues("disk").Inc()
+	s.storeInMemory(id, chunk)
+	return chunk
 }
 
 // Store stores a chunk in the RAM and adds it to the disk storage queue
 func (s *Storage) Store(id string, bytes []byte) error {
+	s.storeInMemory(id, bytes)
+
+	if nil != s.disk {
+		go func() {
+			if err := s.disk.Store(id, bytes); nil != err {
+				Log.Warningf("%v", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (s *Storage) storeInMemory(id string, bytes []byte) {
 	s.lock.Lock()
 
 	deleteID := s.stack.Pop()
@@ -68,6 +100,4 @@ func (s *Storage) Store(id string, bytes []byte) error {
 	s.chunks[id] = bytes
 	s.stack.Push(id)
 	s.lock.Unlock()
-
-	return nil
 }
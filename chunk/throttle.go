@@ -0,0 +1,57 @@
+package chunk
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// minThrottleBurst is the smallest number of bytes read at once from a throttled download
+const minThrottleBurst = 32 * 1024
+
+// newSpeedLimiter creates the limiter shared by all downloads (nil = unlimited),
+// the speed limit is given in bytes per second
+func newSpeedLimiter(speedLimit int64) *rate.Limiter {
+	if speedLimit <= 0 {
+		return nil
+	}
+	burst := int(speedLimit)
+	if burst < minThrottleBurst {
+		burst = minThrottleBurst
+	}
+	return rate.NewLimiter(rate.Limit(speedLimit), burst)
+}
+
+// throttledReader limits the speed of the underlying reader with the shared limiter
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rate.Limiter
+}
+
+// newThrottledReader wraps the reader, it is returned unchanged without a limiter
+func newThrottledReader(ctx context.Context, reader io.Reader, limiter *rate.Limiter) io.Reader {
+	if nil == limiter {
+		return reader
+	}
+	return &throttledReader{
+		ctx:     ctx,
+		reader:  reader,
+		limiter: limiter,
+	}
+}
+
+// Read reads at most one burst and waits until the limiter allows the read bytes
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); nil != waitErr {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
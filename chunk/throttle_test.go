@@ -0,0 +1,34 @@
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestThrottledReader(t *testing.T) {
+	source := bytes.NewReader(make([]byte, 1024))
+	if reader := newThrottledReader(context.Background(), source, newSpeedLimiter(0)); reader != source {
+		t.Fatalf("Expected an unlimited reader to be returned unchanged")
+	}
+
+	limiter := newSpeedLimiter(1024)
+	if minThrottleBurst != limiter.Burst() {
+		t.Fatalf("Expected a burst of %v got %v", minThrottleBurst, limiter.Burst())
+	}
+
+	data := make([]byte, 3*minThrottleBurst/2)
+	reader := newThrottledReader(context.Background(), bytes.NewReader(data), limiter)
+	buffer := make([]byte, len(data))
+	if n, _ := reader.Read(buffer); minThrottleBurst != n {
+		t.Fatalf("Expected a read to be capped at the burst got %v", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reader = newThrottledReader(ctx, bytes.NewReader(data), limiter)
+	if _, err := ioutil.ReadAll(reader); nil == err {
+		t.Fatalf("Expected an error for a cancelled download")
+	}
+}
@@ -0,0 +1,65 @@
+package chunk
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/dweidenfeld/plexdrive/drive"
+)
+
+// Verification is the result of reading a whole object through the chunk manager
+type Verification struct {
+	Size     int64
+	MD5      string
+	Expected string
+	Duration time.Duration
+}
+
+// Matches checks if the checksum of the read content is the one from the metadata
+func (v *Verification) Matches() bool {
+	return v.MD5 == v.Expected
+}
+
+// Throughput gets the read speed in bytes per second
+func (v *Verification) Throughput() float64 {
+	if v.Duration <= 0 {
+		return 0
+	}
+	return float64(v.Size) / v.Duration.Seconds()
+}
+
+// Verify reads the whole object chunk by chunk (like the mount does) and calculates
+// its MD5 checksum, which is compared to the checksum of the metadata
+func (m *Manager) Verify(ctx context.Context, object *drive.APIObject) (*Verification, error) {
+	if "" == object.MD5 {
+		return nil, fmt.Errorf("Object %v (%v) has no checksum (folders and Google Docs can't be verified)", object.ObjectID, object.Name)
+	}
+
+	hash := md5.New()
+	buffer := make([]byte, m.ChunkSize)
+	start := time.Now()
+	offset := int64(0)
+	for uint64(offset) < object.Size {
+		n, err := m.ReadAt(ctx, object, buffer, offset)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not read object %v (%v) at offset %v", object.ObjectID, object.Name, offset)
+		}
+		if 0 == n {
+			return nil, fmt.Errorf("Object %v (%v) ended at offset %v instead of %v", object.ObjectID, object.Name, offset, object.Size)
+		}
+		hash.Write(buffer[:n])
+		offset += int64(n)
+	}
+
+	return &Verification{
+		Size:     offset,
+		MD5:      hex.EncodeToString(hash.Sum(nil)),
+		Expected: object.MD5,
+		Duration: time.Since(start),
+	}, nil
+}
@@ -10,8 +10,10 @@ import (
 
 // Config describes the basic configuration architecture
 type Config struct {
-	ClientID     string
-	ClientSecret string
+	ClientID           string
+	ClientSecret       string
+	ServiceAccountFile string
+	Subject            string
 }
 
 // Read reads the configuration based on a filesystem path
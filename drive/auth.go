@@ -0,0 +1,167 @@
+package drive
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// getTokenFromLoopback requests a token by redirecting the browser to a temporary
+// HTTP server on 127.0.0.1 which receives the authorization code (port 0 = random port)
+func getTokenFromLoopback(ctx context.Context, config *oauth2.Config, port int) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+	if nil != err {
+		return nil, err
+	}
+	defer listener.Close()
+
+	state, err := randomState()
+	if nil != err {
+		return nil, err
+	}
+
+	// the redirect url has to be the same for the auth code url and the exchange
+	loopbackConfig := *config
+	loopbackConfig.RedirectURL = fmt.Sprintf("http://%v", listener.Addr())
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			if state != query.Get("state") {
+				http.Error(w, "Invalid state", http.StatusBadRequest)
+				return
+			}
+			if e := query.Get("error"); "" != e {
+				fmt.Fprintf(w, "Authorization failed (%v), you can close this window.", e)
+				errs <- fmt.Errorf("Authorization failed: %v", e)
+				return
+			}
+			fmt.Fprintf(w, "Authorization successful, you can close this window and return to plexdrive.")
+			codes <- query.Get("code")
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authURL := loopbackConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	fmt.Printf("Go to the following link in your browser %v\n", authURL)
+	Log.Debugf("Waiting for the authorization code on %v", loopbackConfig.RedirectURL)
+
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-errs:
+		return nil, err
+	}
+
+	tok, err := loopbackConfig.Exchange(ctx, code)
+	if nil != err {
+		return nil, fmt.Errorf("Unable to retrieve token from web %v", err)
+	}
+	return tok, nil
+}
+
+// randomState creates a random state parameter to protect the redirect against CSRF
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); nil != err {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isAuthError checks if the token was rejected, either while refreshing it
+// or by the API itself
+func isAuthError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && 401 == apiErr.Code
+}
+
+// isDelegationError checks if the token request of a service account was rejected because
+// it is not allowed to impersonate the subject (no domain-wide delegation for the scopes)
+func isDelegationError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+	return "unauthorized_client" == retrieveErr.ErrorCode ||
+		bytes.Contains(retrieveErr.Body, []byte("unauthorized_client"))
+}
+
+// isRevokedError checks if the token request was rejected because the refresh token (or the
+// key of a service account) is not valid anymore, e.g. the access has been revoked by the user
+func isRevokedError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+	return "invalid_grant" == retrieveErr.ErrorCode ||
+		bytes.Contains(retrieveErr.Body, []byte("invalid_grant"))
+}
+
+// revocationTokenSource reports the result of every token request to the client,
+// so that a revoked authorization is noticed while plexdrive is running
+type revocationTokenSource struct {
+	source oauth2.TokenSource
+	client *Client
+}
+
+// Token gets the token from the underlying source
+func (s *revocationTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	s.client.recordAuthorization(err)
+	return token, err
+}
+
+// recordAuthorization remembers that the authorization has been revoked (and logs how to
+// fix it once) until a token is received again
+func (d *Client) recordAuthorization(err error) {
+	if nil != err && !isRevokedError(err) {
+		return
+	}
+
+	d.authLock.Lock()
+	defer d.authLock.Unlock()
+
+	if nil == err {
+		if !d.revokedAt.IsZero() {
+			Log.Infof("Google Drive accepts the authorization again")
+		}
+		d.revokedAt = time.Time{}
+		return
+	}
+	if !d.revokedAt.IsZero() {
+		return
+	}
+
+	d.revokedAt = time.Now()
+	Log.Debugf("%v", err)
+	if "" != d.serviceAccountFile {
+		Log.Errorf("Google Drive rejects the service account %v, check that its key hasn't been deleted and restart plexdrive", d.serviceAccountFile)
+	} else {
+		Log.Errorf("The access of plexdrive to Google Drive has been revoked, restart plexdrive to authorize again")
+	}
+}
+
+// IsAuthorizationRevoked checks if Google Drive rejected the authorization since plexdrive started
+func (d *Client) IsAuthorizationRevoked() bool {
+	d.authLock.Lock()
+	defer d.authLock.Unlock()
+	return !d.revokedAt.IsZero()
+}
@@ -0,0 +1,55 @@
+package drive
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestIsDelegationError(t *testing.T) {
+	delegation := &oauth2.RetrieveError{Body: []byte(`{"error": "unauthorized_client", "error_description": "Client is unauthorized to retrieve access tokens using this method"}`)}
+	if !isDelegationError(fmt.Errorf("Get: %w", delegation)) {
+		t.Fatalf("Expected unauthorized_client to be a delegation error")
+	}
+	if isDelegationError(&oauth2.RetrieveError{Body: []byte(`{"error": "invalid_grant"}`)}) {
+		t.Fatalf("Expected invalid_grant not to be a delegation error")
+	}
+	if isDelegationError(fmt.Errorf("timeout")) {
+		t.Fatalf("Expected other errors not to be delegation errors")
+	}
+}
+
+func TestRevokedAuthorization(t *testing.T) {
+	client := &Client{}
+	var err error = &oauth2.RetrieveError{ErrorCode: "invalid_grant"}
+	client.tokenSource = &revocationTokenSource{client: client, source: tokenSourceFunc(func() (*oauth2.Token, error) {
+		if nil != err {
+			return nil, err
+		}
+		return &oauth2.Token{AccessToken: "token"}, nil
+	})}
+
+	client.tokenSource.Token()
+	if !client.IsAuthorizationRevoked() {
+		t.Fatalf("Expected invalid_grant to revoke the authorization")
+	}
+
+	err = fmt.Errorf("timeout")
+	client.tokenSource.Token()
+	if !client.IsAuthorizationRevoked() {
+		t.Fatalf("Expected other errors to keep the revoked state")
+	}
+
+	err = nil
+	client.tokenSource.Token()
+	if client.IsAuthorizationRevoked() {
+		t.Fatalf("Expected a new token to end the revoked state")
+	}
+}
+
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
@@ -0,0 +1,493 @@
+package drive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+
+	"github.com/boltdb/bolt"
+)
+
+// BoltCache is the cache stored in a BoltDB file
+type BoltCache struct {
+	*tokenFile
+	db      *bolt.DB
+	lookups lookupCounter
+}
+
+// boltSchemaVersion is the version of the cache layout, the cache is
+// rebuilt when the stored version differs
+const boltSchemaVersion = "4"
+
+// boltOpenTimeout is the time to wait for the lock of the cache file,
+// it is held by another running plexdrive process otherwise
+const boltOpenTimeout = 5 * time.Second
+
+var (
+	bObjects   = []byte("api_objects")
+	bParents   = []byte("idx_api_objects_py_parent")
+	bPageToken = []byte("page_token")
+	bMeta      = []byte("meta")
+	bCrawl     = []byte("crawl")
+)
+
+// NewBoltCache creates a new cache instance (the token file is encrypted when a token key is given)
+func NewBoltCache(cacheFile, configPath string, tokenKey []byte, sqlDebug bool) (*BoltCache, error) {
+	Log.Debugf("Opening cache connection")
+
+	db, err := bolt.Open(cacheFile, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open cache file %v (is another plexdrive process using it?)", cacheFile)
+	}
+
+	cache := BoltCache{
+		tokenFile: newTokenFile(configPath, tokenKey),
+		db:        db,
+	}
+
+	// Make sure the necessary buckets exist
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := boltMigrate(tx); nil != err {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(bObjects); nil != err {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(bParents); nil != err {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(bPageToken); nil != err {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(bCrawl); nil != err {
+			return err
+		}
+		return nil
+	})
+
+	return &cache, err
+}
+
+// Close closes all handles
+func (c *BoltCache) Close() error {
+	Log.Debugf("Closing cache file")
+	c.db.Close()
+	return nil
+}
+
+// GetObject gets an object by id
+func (c *BoltCache) GetObject(id string) (object *APIObject, err error) {
+	Log.Tracef("Getting object %v", id)
+
+	c.db.View(func(tx *bolt.Tx) error {
+		object, err = boltGetObject(tx, id)
+		return nil
+	})
+	c.lookups.count(err)
+	if nil != err {
+		return nil, err
+	}
+
+	Log.Tracef("Got object from cache %v", object)
+	return object, err
+}
+
+// GetObjects gets all objects for the given ids in one transaction (unknown ids are skipped)
+func (c *BoltCache) GetObjects(ids []string) ([]*APIObject, error) {
+	Log.Tracef("Getting objects %v", ids)
+
+	objects := make([]*APIObject, 0, len(ids))
+	c.db.View(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			if object, err := boltGetObject(tx, id); nil == err {
+				objects = append(objects, object)
+			} else {
+				Log.Tracef("%v", err)
+			}
+		}
+		return nil
+	})
+
+	Log.Tracef("Got objects from cache %v", objects)
+	return objects, nil
+}
+
+// GetObjectsByParent get all objects under parent id
+func (c *BoltCache) GetObjectsByParent(parent string) ([]*APIObject, error) {
+	Log.Tracef("Getting children for %v", parent)
+
+	objects := make([]*APIObject, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		cr := tx.Bucket(bParents).Cursor()
+
+		// Iterate over all object ids stored under the parent in the index
+		objectIds := make([]string, 0)
+		prefix := []byte(parent + "/")
+		for k, v := cr.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cr.Next() {
+			objectIds = append(objectIds, string(v))
+		}
+
+		// Fetch all objects for the given ids
+		for _, id := range objectIds {
+			if object, err := boltGetObject(tx, id); nil == err {
+				objects = append(objects, object)
+			}
+		}
+		return nil
+	})
+
+	Log.Tracef("Got objects from cache %v", objects)
+	return objects, nil
+}
+
+// GetObjectByParentAndName finds a child element by name and its parent id (the lowest
+// id when several children have the same name)
+func (c *BoltCache) GetObjectByParentAndName(parent, name string) (object *APIObject, err error) {
+	Log.Tracef("Getting object %v in parent %v", name, parent)
+
+	c.db.View(func(tx *bolt.Tx) error {
+		// Look up object id in parent-name index, the lowest id of objects with the same name
+		prefix := boltIndexKey(parent, name, "")
+		k, v := tx.Bucket(bParents).Cursor().Seek(prefix)
+		if nil == k || !bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+
+		// Fetch object for given id
+		object, err = boltGetObject(tx, string(v))
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	if object == nil {
+		c.lookups.count(ErrNotFound)
+		return nil, fmt.Errorf("Could not find object with name %v in parent %v: %w", name, parent, ErrNotFound)
+	}
+	c.lookups.count(nil)
+
+	Log.Tracef("Got object from cache %v", object)
+	return object, nil
+}
+
+// DeleteObject deletes an object by id
+func (c *BoltCache) DeleteObject(id string) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return boltDeleteObject(tx, id)
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not delete object %v", id)
+	}
+
+	return nil
+}
+
+// UpdateObject updates an object
+func (c *BoltCache) UpdateObject(object *APIObject) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return boltUpdateObject(tx, object)
+	})
+
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not update/save object %v (%v)", object.ObjectID, object.Name)
+	}
+
+	return nil
+}
+
+// boltMigrate drops all cached objects when the schema version changed,
+// so that the cache is rebuilt from the beginning
+func boltMigrate(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists(bMeta)
+	if nil != err {
+		return err
+	}
+
+	version := string(meta.Get([]byte("version")))
+	if boltSchemaVersion == version {
+		return nil
+	}
+
+	// a new cache file has no version and no objects yet
+	if "" != version || nil != tx.Bucket(bObjects) {
+		Log.Infof("Cache schema changed (%v -> %v), rebuilding cache", version, boltSchemaVersion)
+	}
+	for _, bucket := range [][]byte{bObjects, bParents, bPageToken, bCrawl} {
+		if err := tx.DeleteBucket(bucket); nil != err && bolt.ErrBucketNotFound != err {
+			return err
+		}
+	}
+	if err := meta.Delete([]byte("source")); nil != err {
+		return err
+	}
+	return meta.Put([]byte("version"), []byte(boltSchemaVersion))
+}
+
+// boltIndexKey gets the key of the parent-name index, the id is part of the key because
+// a folder can contain several objects with the same name
+func boltIndexKey(parent, name, id string) []byte {
+	return []byte(parent + "/" + name + "\x00" + id)
+}
+
+func boltStoreObject(tx *bolt.Tx, object *APIObject) error {
+	b := tx.Bucket(bObjects)
+	v, err := json.Marshal(object)
+	if nil != err {
+		return err
+	}
+	return b.Put([]byte(object.ObjectID), v)
+}
+
+func boltGetObject(tx *bolt.Tx, id string) (*APIObject, error) {
+	b := tx.Bucket(bObjects)
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, fmt.Errorf("Could not find object %v in cache: %w", id, ErrNotFound)
+	}
+
+	var object APIObject
+	err := json.Unmarshal(v, &object)
+	return &object, err
+}
+
+func boltDeleteObject(tx *bolt.Tx, id string) error {
+	object, _ := boltGetObject(tx, id)
+	if nil == object {
+		return nil
+	}
+
+	if err := tx.Bucket(bObjects).Delete([]byte(id)); nil != err {
+		return err
+	}
+
+	// Remove object ids from the index
+	b := tx.Bucket(bParents)
+	for _, parent := range indexParents(object) {
+		b.Delete(boltIndexKey(parent, object.Name, object.ObjectID))
+	}
+	return nil
+}
+
+func boltUpdateObject(tx *bolt.Tx, object *APIObject) error {
+	prev, _ := boltGetObject(tx, object.ObjectID)
+	if nil != prev {
+		// Remove object ids from the index
+		b := tx.Bucket(bParents)
+		for _, parent := range indexParents(prev) {
+			b.Delete(boltIndexKey(parent, prev.Name, prev.ObjectID))
+		}
+	}
+
+	if err := boltStoreObject(tx, object); nil != err {
+		return err
+	}
+
+	// Store the object id by parent-name in the index
+	b := tx.Bucket(bParents)
+	for _, parent := range indexParents(object) {
+		if err := b.Put(boltIndexKey(parent, object.Name, object.ObjectID), []byte(object.ObjectID)); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchUpdateObjects updates multiple objects in one transaction
+func (c *BoltCache) BatchUpdateObjects(objects []*APIObject) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for _, object := range objects {
+			if err := boltUpdateObject(tx, object); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not update/save objects: %v", err)
+	}
+
+	return nil
+}
+
+// Stats gets the number and size of the cached objects and the lookup counters
+// (all objects are read, so this is too expensive to be called for every request)
+func (c *BoltCache) Stats() (*CacheStats, error) {
+	stats := &CacheStats{}
+	c.db.View(func(tx *bolt.Tx) error {
+		stats.Bytes = tx.Size()
+		return nil
+	})
+	err := c.ForEachObject(func(object *APIObject) error {
+		stats.addObject(object)
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	c.lookups.fill(stats)
+	return stats, nil
+}
+
+// ForEachObject calls fn for every cached object, objects that can't be read are skipped
+func (c *BoltCache) ForEachObject(fn func(object *APIObject) error) error {
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bObjects).ForEach(func(k, v []byte) error {
+			var object APIObject
+			if err := json.Unmarshal(v, &object); nil != err {
+				Log.Debugf("%v", err)
+				return nil
+			}
+			return fn(&object)
+		})
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not get objects from cache")
+	}
+	return nil
+}
+
+// ApplyChanges deletes and updates the objects of one page of changes and stores the
+// page token to continue with in one transaction
+func (c *BoltCache) ApplyChanges(objects []*APIObject, deletedIDs []string, pageToken string) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range deletedIDs {
+			if err := boltDeleteObject(tx, id); nil != err {
+				return err
+			}
+		}
+		for _, object := range objects {
+			if err := boltUpdateObject(tx, object); nil != err {
+				return err
+			}
+		}
+		return tx.Bucket(bPageToken).Put([]byte("t"), []byte(pageToken))
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not apply changes (%v updated, %v deleted): %v", len(objects), len(deletedIDs), err)
+	}
+
+	return nil
+}
+
+// StoreStartPageToken stores the page token for changes
+func (c *BoltCache) StoreStartPageToken(token string) error {
+	Log.Debugf("Storing page token %v in cache", token)
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bPageToken)
+		return b.Put([]byte("t"), []byte(token))
+	})
+
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store token %v", token)
+	}
+
+	return nil
+}
+
+// GetStartPageToken gets the start page token
+func (c *BoltCache) GetStartPageToken() (string, error) {
+	var pageToken string
+
+	Log.Debugf("Getting start page token from cache")
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bPageToken)
+		v := b.Get([]byte("t"))
+		pageToken = string(v)
+		return nil
+	})
+	if pageToken == "" {
+		return "", fmt.Errorf("Could not get token from cache, token is empty")
+	}
+
+	Log.Tracef("Got start page token %v", pageToken)
+	return pageToken, nil
+}
+
+// StoreCrawlState stores the progress of warming the cache
+func (c *BoltCache) StoreCrawlState(state *CrawlState) error {
+	data, err := json.Marshal(state)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not marshal crawl state")
+	}
+
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bCrawl).Put([]byte("state"), data)
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store crawl state")
+	}
+
+	return nil
+}
+
+// LoadCrawlState loads the progress of warming the cache (nil if no walk has been started)
+func (c *BoltCache) LoadCrawlState() (*CrawlState, error) {
+	var state *CrawlState
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bCrawl).Get([]byte("state"))
+		if nil == data {
+			return nil
+		}
+		state = &CrawlState{}
+		return json.Unmarshal(data, state)
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not load crawl state")
+	}
+
+	return state, nil
+}
+
+// StoreSource stores the root folder and drive the cache is built for
+func (c *BoltCache) StoreSource(source *CacheSource) error {
+	data, err := json.Marshal(source)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not marshal cache source")
+	}
+
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bMeta).Put([]byte("source"), data)
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store cache source")
+	}
+
+	return nil
+}
+
+// LoadSource loads the root folder and drive the cache is built for (nil if unknown)
+func (c *BoltCache) LoadSource() (*CacheSource, error) {
+	var source *CacheSource
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bMeta).Get([]byte("source"))
+		if nil == data {
+			return nil
+		}
+		source = &CacheSource{}
+		return json.Unmarshal(data, source)
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not load cache source")
+	}
+
+	return source, nil
+}
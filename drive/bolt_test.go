@@ -0,0 +1,108 @@
+package drive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func newTestCache(t *testing.T) (*BoltCache, func()) {
+	dir, err := ioutil.TempDir("", "plexdrive-cache")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	cache, err := NewBoltCache(filepath.Join(dir, "cache.bolt"), dir, nil, false)
+	if nil != err {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return cache, func() {
+		cache.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMultipleParents(t *testing.T) {
+	cache, cleanup := newTestCache(t)
+	defer cleanup()
+
+	if err := cache.UpdateObject(&APIObject{ObjectID: "1", Name: "file", Parents: []string{"a", "b"}}); nil != err {
+		t.Fatal(err)
+	}
+
+	for _, parent := range []string{"a", "b"} {
+		objects, _ := cache.GetObjectsByParent(parent)
+		if 1 != len(objects) || "1" != objects[0].ObjectID {
+			t.Fatalf("Expected object 1 in parent %v got %v", parent, objects)
+		}
+		if _, err := cache.GetObjectByParentAndName(parent, "file"); nil != err {
+			t.Fatalf("Expected object file in parent %v got %v", parent, err)
+		}
+	}
+
+	if err := cache.UpdateObject(&APIObject{ObjectID: "1", Name: "file", Parents: []string{"b"}}); nil != err {
+		t.Fatal(err)
+	}
+	if objects, _ := cache.GetObjectsByParent("a"); 0 != len(objects) {
+		t.Fatalf("Expected no objects in parent a got %v", objects)
+	}
+}
+
+func TestObjectWithoutParent(t *testing.T) {
+	cache, cleanup := newTestCache(t)
+	defer cleanup()
+
+	if err := cache.UpdateObject(&APIObject{ObjectID: "1", Name: "file"}); nil != err {
+		t.Fatal(err)
+	}
+
+	objects, _ := cache.GetObjectsByParent(SharedFolderID)
+	if 1 != len(objects) || "1" != objects[0].ObjectID {
+		t.Fatalf("Expected object 1 in shared folder got %v", objects)
+	}
+
+	if err := cache.DeleteObject("1"); nil != err {
+		t.Fatal(err)
+	}
+	if objects, _ := cache.GetObjectsByParent(SharedFolderID); 0 != len(objects) {
+		t.Fatalf("Expected no objects in shared folder got %v", objects)
+	}
+}
+
+func TestSchemaChangeRebuildsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-cache")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheFile := filepath.Join(dir, "cache.bolt")
+	cache, err := NewBoltCache(cacheFile, dir, nil, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cache.UpdateObject(&APIObject{ObjectID: "1", Name: "file", Parents: []string{"a"}})
+	cache.StoreStartPageToken("42")
+	cache.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bMeta).Put([]byte("version"), []byte("1"))
+	})
+	cache.Close()
+
+	cache, err = NewBoltCache(cacheFile, dir, nil, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	if _, err := cache.GetObject("1"); nil == err {
+		t.Fatalf("Expected object 1 to be dropped after schema change")
+	}
+	if token, _ := cache.GetStartPageToken(); "" != token {
+		t.Fatalf("Expected page token to be dropped after schema change, got %v", token)
+	}
+}
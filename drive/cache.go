@@ -1,332 +1,212 @@
 package drive
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"path/filepath"
-
+	"errors"
+	"sync/atomic"
 	"time"
 
-	. "github.com/claudetech/loggo/default"
+	"github.com/dweidenfeld/plexdrive/metrics"
 	"golang.org/x/oauth2"
-
-	"github.com/boltdb/bolt"
-)
-
-// Cache is the cache
-type Cache struct {
-	db        *bolt.DB
-	tokenPath string
-}
-
-var (
-	bObjects   = []byte("api_objects")
-	bParents   = []byte("idx_api_objects_py_parent")
-	bPageToken = []byte("page_token")
 )
 
-// APIObject is a Google Drive file object
-type APIObject struct {
-	ObjectID     string
-	Name         string
-	IsDir        bool
-	Size         uint64
-	LastModified time.Time
-	DownloadURL  string
-	Parents      []string
-	CanTrash     bool
-}
-
-// PageToken is the last change id
-type PageToken struct {
+// Cache is the metadata cache backend (objects, page token and OAuth token)
+type Cache interface {
+	// Close closes all handles
+	Close() error
+	// LoadToken loads a token from cache
+	LoadToken() (*oauth2.Token, error)
+	// StoreToken stores a token in the cache or updates the existing token element
+	StoreToken(token *oauth2.Token) error
+	// GetObject gets an object by id
+	GetObject(id string) (*APIObject, error)
+	// GetObjects gets all objects for the given ids (unknown ids are skipped)
+	GetObjects(ids []string) ([]*APIObject, error)
+	// GetObjectsByParent get all objects under parent id
+	GetObjectsByParent(parent string) ([]*APIObject, error)
+	// GetObjectByParentAndName finds a child element by name and its parent id (the lowest id
+	// when several children have the same name)
+	GetObjectByParentAndName(parent, name string) (*APIObject, error)
+	// DeleteObject deletes an object by id
+	DeleteObject(id string) error
+	// UpdateObject updates an object
+	UpdateObject(object *APIObject) error
+	// BatchUpdateObjects updates multiple objects at once
+	BatchUpdateObjects(objects []*APIObject) error
+	// ApplyChanges deletes and updates the objects of one page of changes and stores
+	// the page token in one transaction
+	ApplyChanges(objects []*APIObject, deletedIDs []string, pageToken string) error
+	// StoreStartPageToken stores the page token for changes
+	StoreStartPageToken(token string) error
+	// GetStartPageToken gets the start page token
+	GetStartPageToken() (string, error)
+	// Stats gets the number and size of the cached objects and the lookup counters
+	Stats() (*CacheStats, error)
+	// StoreCrawlState stores the progress of warming the cache
+	StoreCrawlState(state *CrawlState) error
+	// LoadCrawlState loads the progress of warming the cache (nil if no walk has been started)
+	LoadCrawlState() (*CrawlState, error)
+	// StoreSource stores the root folder and drive the cache is built for
+	StoreSource(source *CacheSource) error
+	// LoadSource loads the root folder and drive the cache is built for (nil if unknown)
+	LoadSource() (*CacheSource, error)
+}
+
+// CrawlState is the progress of warming the cache, an interrupted walk is resumed
+// with the pending folders after a restart
+type CrawlState struct {
+	Root     string
+	MaxDepth int
+	// FoldersOnly is set when only the folders are listed
+	FoldersOnly bool
+	// Pending are the folders that haven't been listed completely yet
+	Pending []CrawlFolder
+	// Visited are the ids of all folders that have been listed or are pending
+	Visited []string
+	// Complete is set once all folders have been listed
+	Complete bool
+}
+
+// CrawlFolder is a folder that is waiting to be listed
+type CrawlFolder struct {
 	ID    string
-	Token string
-}
-
-// NewCache creates a new cache instance
-func NewCache(cacheFile, configPath string, sqlDebug bool) (*Cache, error) {
-	Log.Debugf("Opening cache connection")
-
-	db, err := bolt.Open(cacheFile, 0600, nil)
-	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not open cache file")
-	}
-
-	cache := Cache{
-		db:        db,
-		tokenPath: filepath.Join(configPath, "token.json"),
-	}
-
-	// Make sure the necessary buckets exist
-	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(bObjects); nil != err {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists(bParents); nil != err {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists(bPageToken); nil != err {
-			return err
-		}
-		return nil
-	})
-
-	return &cache, err
-}
-
-// Close closes all handles
-func (c *Cache) Close() error {
-	Log.Debugf("Closing cache file")
-	c.db.Close()
-	return nil
-}
-
-// LoadToken loads a token from cache
-func (c *Cache) LoadToken() (*oauth2.Token, error) {
-	Log.Debugf("Loading token from cache")
-
-	tokenFile, err := ioutil.ReadFile(c.tokenPath)
-	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not read token file in %v", c.tokenPath)
-	}
-
-	var token oauth2.Token
-	json.Unmarshal(tokenFile, &token)
-
-	Log.Tracef("Got token from cache %v", token)
-
-	return &token, nil
+	Depth int
 }
 
-// StoreToken stores a token in the cache or updates the existing token element
-func (c *Cache) StoreToken(token *oauth2.Token) error {
-	Log.Debugf("Storing token to cache")
-
-	tokenJSON, err := json.Marshal(token)
-	if nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not generate token.json content")
-	}
-
-	if err := ioutil.WriteFile(c.tokenPath, tokenJSON, 0644); nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not generate token.json file")
-	}
-
-	return nil
-}
-
-// GetObject gets an object by id
-func (c *Cache) GetObject(id string) (object *APIObject, err error) {
-	Log.Tracef("Getting object %v", id)
-
-	c.db.View(func(tx *bolt.Tx) error {
-		object, err = boltGetObject(tx, id)
-		return nil
-	})
-	if nil != err {
-		return nil, err
-	}
-
-	Log.Tracef("Got object from cache %v", object)
-	return object, err
+// CacheSource is the root folder and drive a cache is built for, a cache can only be
+// used as replica by instances with the same source
+type CacheSource struct {
+	Root    string
+	DriveID string
 }
 
-// GetObjectsByParent get all objects under parent id
-func (c *Cache) GetObjectsByParent(parent string) ([]*APIObject, error) {
-	Log.Tracef("Getting children for %v", parent)
-
-	objects := make([]*APIObject, 0)
-	c.db.View(func(tx *bolt.Tx) error {
-		cr := tx.Bucket(bParents).Cursor()
-
-		// Iterate over all object ids stored under the parent in the index
-		objectIds := make([]string, 0)
-		prefix := []byte(parent + "/")
-		for k, v := cr.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cr.Next() {
-			objectIds = append(objectIds, string(v))
-		}
-
-		// Fetch all objects for the given ids
-		for _, id := range objectIds {
-			if object, err := boltGetObject(tx, id); nil == err {
-				objects = append(objects, object)
-			}
-		}
-		return nil
-	})
-
-	Log.Tracef("Got objects from cache %v", objects)
-	return objects, nil
+// CacheStats describes the content of the cache
+type CacheStats struct {
+	// Objects is the number of cached objects
+	Objects int `json:"objects"`
+	// Bytes is the size of the cache (including the indexes)
+	Bytes int64 `json:"bytes"`
+	// OldestEntry is the time the least recently fetched object has been cached
+	// (objects cached by older versions without this time are skipped)
+	OldestEntry time.Time `json:"oldest_entry"`
+	// Hits and Misses count the object lookups since start
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
 }
 
-// GetObjectByParentAndName finds a child element by name and its parent id
-func (c *Cache) GetObjectByParentAndName(parent, name string) (object *APIObject, err error) {
-	Log.Tracef("Getting object %v in parent %v", name, parent)
-
-	c.db.View(func(tx *bolt.Tx) error {
-		// Look up object id in parent-name index
-		b := tx.Bucket(bParents)
-		v := b.Get([]byte(parent + "/" + name))
-		if nil == v {
-			return nil
-		}
-
-		// Fetch object for given id
-		object, err = boltGetObject(tx, string(v))
-		return nil
-	})
-	if nil != err {
-		return nil, err
-	}
-
-	if object == nil {
-		return nil, fmt.Errorf("Could not find object with name %v in parent %v", name, parent)
+// HitRatio gets the share of the lookups that found an object
+func (s *CacheStats) HitRatio() float64 {
+	if 0 == s.Hits+s.Misses {
+		return 0
 	}
-
-	Log.Tracef("Got object from cache %v", object)
-	return object, nil
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
 }
 
-// DeleteObject deletes an object by id
-func (c *Cache) DeleteObject(id string) error {
-	err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bObjects)
-		object, _ := boltGetObject(tx, id)
-		if nil == object {
-			return nil
-		}
-
-		b.Delete([]byte(id))
-
-		// Remove object ids from the index
-		b = tx.Bucket(bParents)
-		for _, parent := range object.Parents {
-			b.Delete([]byte(parent + "/" + object.Name))
-		}
-
-		return nil
-	})
-	if nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not delete object %v", id)
+// addObject counts the object in the stats
+func (s *CacheStats) addObject(object *APIObject) {
+	s.Objects++
+	if !object.CachedAt.IsZero() && (s.OldestEntry.IsZero() || object.CachedAt.Before(s.OldestEntry)) {
+		s.OldestEntry = object.CachedAt
 	}
-
-	return nil
 }
 
-// UpdateObject updates an object
-func (c *Cache) UpdateObject(object *APIObject) error {
-	err := c.db.Update(func(tx *bolt.Tx) error {
-		return boltUpdateObject(tx, object)
-	})
-
-	if nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not update/save object %v (%v)", object.ObjectID, object.Name)
-	}
-
-	return nil
+// lookupCounter counts the object lookups of a cache
+type lookupCounter struct {
+	hits   uint64
+	misses uint64
 }
 
-func boltStoreObject(tx *bolt.Tx, object *APIObject) error {
-	b := tx.Bucket(bObjects)
-	v, err := json.Marshal(object)
-	if nil != err {
-		return err
+// count counts the result of a lookup, only not found errors are misses
+func (l *lookupCounter) count(err error) {
+	if nil == err {
+		atomic.AddUint64(&l.hits, 1)
+		metrics.CacheLookups.WithLabelValues("hit").Inc()
+	} else if errors.Is(err, ErrNotFound) {
+		atomic.AddUint64(&l.misses, 1)
+		metrics.CacheLookups.WithLabelValues("miss").Inc()
 	}
-	return b.Put([]byte(object.ObjectID), v)
 }
 
-func boltGetObject(tx *bolt.Tx, id string) (*APIObject, error) {
-	b := tx.Bucket(bObjects)
-	v := b.Get([]byte(id))
-	if v == nil {
-		return nil, fmt.Errorf("Could not find object %v in cache", id)
-	}
-
-	var object APIObject
-	err := json.Unmarshal(v, &object)
-	return &object, err
+// fill sets the lookup counters of the stats
+func (l *lookupCounter) fill(stats *CacheStats) {
+	stats.Hits = atomic.LoadUint64(&l.hits)
+	stats.Misses = atomic.LoadUint64(&l.misses)
 }
 
-func boltUpdateObject(tx *bolt.Tx, object *APIObject) error {
-	prev, _ := boltGetObject(tx, object.ObjectID)
-	if nil != prev {
-		// Remove object ids from the index
-		b := tx.Bucket(bParents)
-		for _, parent := range prev.Parents {
-			b.Delete([]byte(parent + "/" + prev.Name))
-		}
-	}
-
-	if err := boltStoreObject(tx, object); nil != err {
-		return err
-	}
-
-	// Store the object id by parent-name in the index
-	b := tx.Bucket(bParents)
-	for _, parent := range object.Parents {
-		if err := b.Put([]byte(parent+"/"+object.Name), []byte(object.ObjectID)); nil != err {
-			return err
-		}
-	}
-	return nil
+// APIObject is a Google Drive file object
+type APIObject struct {
+	ObjectID     string
+	Name         string
+	IsDir        bool
+	Size         uint64
+	LastModified time.Time
+	// MTime is the timestamp selected by MTimeSource that is shown as modification time, all
+	// cached content (chunks, export sizes, revisions) depends on LastModified instead
+	MTime          time.Time
+	DownloadURL    string
+	Parents        []string
+	CanTrash       bool
+	DriveID        string
+	MimeType       string
+	MD5            string
+	ExportMimeType string
+	// ExportSizeKnown is set once the export size of a native Google Docs file has been
+	// determined, the size of an empty export is 0 as well
+	ExportSizeKnown bool
+	// ShortcutTargetID is the id of the object a shortcut points to
+	ShortcutTargetID string
+	// CachedAt is the time the object has been fetched from the API
+	CachedAt time.Time
+	// Trashed is set for objects that have been moved to the trash (they are only stored
+	// when the trash is shown, children of a trashed folder stay in the folder)
+	Trashed bool
+	// Video is the metadata of video files (nil for other files and while Google Drive
+	// is still processing the video)
+	Video *VideoMetadata
+	// Photos is set for objects that only exist in the Google Photos space, they can't
+	// be changed through Google Drive
+	Photos bool
+}
+
+// VideoMetadata is the resolution and duration of a video file
+type VideoMetadata struct {
+	Width    int64
+	Height   int64
+	Duration time.Duration
+}
+
+// GetMTime gets the time shown as modification time, objects without MTime (e.g. virtual
+// folders and revisions) show LastModified
+func (o *APIObject) GetMTime() time.Time {
+	if o.MTime.IsZero() {
+		return o.LastModified
+	}
+	return o.MTime
+}
+
+// GetDownloadURL gets the URL the content of the object is read from (with Range headers),
+// objects without a stored URL are read directly with alt=media
+func (o *APIObject) GetDownloadURL() string {
+	if "" != o.DownloadURL {
+		return o.DownloadURL
+	}
+	return getDownloadURL(o.ObjectID, o.ExportMimeType)
 }
 
-func (c *Cache) BatchUpdateObjects(objects []*APIObject) error {
-	err := c.db.Update(func(tx *bolt.Tx) error {
-		for _, object := range objects {
-			if err := boltUpdateObject(tx, object); nil != err {
-				return err
-			}
-		}
-		return nil
-	})
-
-	if nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not update/save objects: %v", err)
-	}
-
-	return nil
+// PageToken is the last change id
+type PageToken struct {
+	ID    string
+	Token string
 }
 
-// StoreStartPageToken stores the page token for changes
-func (c *Cache) StoreStartPageToken(token string) error {
-	Log.Debugf("Storing page token %v in cache", token)
-	err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bPageToken)
-		return b.Put([]byte("t"), []byte(token))
-	})
-
-	if nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not store token %v", token)
+// indexParents gets the parents an object is indexed under, objects
+// without any parent (e.g. shared with me) are indexed under the shared folder
+// and trashed objects only under the trash folder
+func indexParents(object *APIObject) []string {
+	if object.Trashed {
+		return []string{TrashFolderID}
 	}
-
-	return nil
-}
-
-// GetStartPageToken gets the start page token
-func (c *Cache) GetStartPageToken() (string, error) {
-	var pageToken string
-
-	Log.Debugf("Getting start page token from cache")
-	c.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bPageToken)
-		v := b.Get([]byte("t"))
-		pageToken = string(v)
-		return nil
-	})
-	if pageToken == "" {
-		return "", fmt.Errorf("Could not get token from cache, token is empty")
+	if 0 == len(object.Parents) {
+		return []string{SharedFolderID}
 	}
-
-	Log.Tracef("Got start page token %v", pageToken)
-	return pageToken, nil
+	return object.Parents
 }
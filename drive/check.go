@@ -0,0 +1,138 @@
+package drive
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/dweidenfeld/plexdrive/config"
+	"github.com/dweidenfeld/plexdrive/metrics"
+	gdrive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// AccountInfo is the result of an account check
+type AccountInfo struct {
+	User         string
+	Email        string
+	Scope        string
+	TokenExpiry  time.Time
+	QuotaLimit   int64
+	QuotaUsage   int64
+	RootName     string
+	RootChildren int
+}
+
+// AccountStatus is the current state of the mounted account
+type AccountStatus struct {
+	User        string    `json:"user,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Active      bool      `json:"active"`
+	Revoked     bool      `json:"authorization_revoked"`
+	Degraded    bool      `json:"degraded"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+	QuotaLimit  int64     `json:"quota_limit"`
+	QuotaUsage  int64     `json:"quota_usage"`
+}
+
+// CheckAccount authorizes like a mount (without watching for changes) and gets the
+// account, the quota and the number of files in the root folder from the API
+func CheckAccount(config *config.Config, cache Cache, rootNodeID string, driveID string, authPort int, readOnly bool, httpOptions HTTPOptions) (*AccountInfo, error) {
+	d, err := newClient(config, cache, rootNodeID, driveID, false, authPort, readOnly, httpOptions)
+	if nil != err {
+		return nil, err
+	}
+
+	about, err := d.getAbout()
+	if nil != err {
+		return nil, err
+	}
+	var info AccountInfo
+	if nil != about.User {
+		info.User = about.User.DisplayName
+		info.Email = about.User.EmailAddress
+	}
+	if nil != about.StorageQuota {
+		info.QuotaLimit = about.StorageQuota.Limit
+		info.QuotaUsage = about.StorageQuota.Usage
+	}
+
+	token, err := d.tokenSource.Token()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get token")
+	}
+	info.TokenExpiry = token.Expiry
+	info.Scope = tokenScope(token)
+	if "" == info.Scope {
+		info.Scope = d.config.Scopes[0]
+	}
+
+	root, err := d.getRootObject()
+	if nil != err {
+		return nil, err
+	}
+	info.RootName = root.Name
+	children, err := d.listChildren(root.ObjectID)
+	if nil != err {
+		return nil, err
+	}
+	info.RootChildren = len(children)
+
+	return &info, nil
+}
+
+// AccountStatus gets the user and the storage quota of the account from the API and
+// updates the quota metrics, the state of the client (revoked, degraded and the error
+// of the last failed change check) is returned even if the API can't be reached
+func (d *Client) AccountStatus() (*AccountStatus, error) {
+	// the API call is done first, it notices a revoked authorization
+	about, err := d.getAbout()
+
+	status := &AccountStatus{
+		Revoked:  d.IsAuthorizationRevoked(),
+		Degraded: d.IsDegraded(),
+	}
+	status.Active = !status.Revoked && !status.Degraded
+	d.degradedLock.Lock()
+	status.LastError = d.lastError
+	status.LastErrorAt = d.lastErrorAt
+	d.degradedLock.Unlock()
+	if nil != err {
+		return status, err
+	}
+
+	if nil != about.User {
+		status.User = about.User.DisplayName
+		status.Email = about.User.EmailAddress
+	}
+	if nil != about.StorageQuota {
+		status.QuotaLimit = about.StorageQuota.Limit
+		status.QuotaUsage = about.StorageQuota.Usage
+		metrics.QuotaLimit.Set(float64(status.QuotaLimit))
+		metrics.QuotaUsage.Set(float64(status.QuotaUsage))
+	}
+	return status, nil
+}
+
+// getAbout gets the user and the storage quota of the account from the API
+func (d *Client) getAbout() (*gdrive.About, error) {
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	var about *gdrive.About
+	err = doWithRetry("get the account status", func() error {
+		var err error
+		about, err = client.About.Get().Fields(googleapi.Field("user(displayName, emailAddress), storageQuota(limit, usage)")).Do()
+		return err
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get account information from API: %w", err)
+	}
+	return about, nil
+}
@@ -0,0 +1,33 @@
+package drive
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestAccountStatus(t *testing.T) {
+	handler := func(r *http.Request) (int, string) {
+		body := `{"user": {"displayName": "Plex", "emailAddress": "plex@example.com"}, "storageQuota": {"limit": "100", "usage": "42"}}`
+		return 200, body
+	}
+	client := newTestClient(nil, handler)
+
+	status, err := client.AccountStatus()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !status.Active || "plex@example.com" != status.Email || 100 != status.QuotaLimit || 42 != status.QuotaUsage {
+		t.Fatalf("Expected the active account with its quota got %+v", status)
+	}
+
+	client.recordChangeCheck(errors.New("network is unreachable"))
+	client.recordChangeCheck(errors.New("connection refused"))
+	status, err = client.AccountStatus()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if status.Active || !status.Degraded || "connection refused" != status.LastError || status.LastErrorAt.IsZero() {
+		t.Fatalf("Expected the degraded account with the last error got %+v", status)
+	}
+}
@@ -0,0 +1,328 @@
+package drive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	gdrive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// defaultLinkTTL is the time a temporary link is valid when no ttl is requested
+const defaultLinkTTL = 30 * time.Minute
+
+// ControlResult is the response of a control command
+type ControlResult struct {
+	ObjectID string `json:"object_id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Objects  int    `json:"objects"`
+	Link     string `json:"link,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Refresh fetches the object (a path starting with / or an object id) from the API
+// and stores it in the cache, the children of directories are listed as well
+// (children that don't exist anymore are removed from the cache)
+func (d *Client) Refresh(target string) (*ControlResult, error) {
+	object, err := d.resolveTarget(target)
+	if nil != err {
+		return nil, err
+	}
+	if SharedFolderID == object.ObjectID {
+		return nil, fmt.Errorf("Could not refresh the virtual shared folder, it is refreshed by the changes")
+	}
+
+	result, err := d.refreshObject(object)
+	if nil != err {
+		return nil, err
+	}
+
+	Log.Infof("Refreshed %v (%v objects)", target, result.Objects)
+	return result, nil
+}
+
+// refreshObject fetches the object and the children of directories from the API and
+// stores them in the cache (children that don't exist anymore are removed from the cache)
+func (d *Client) refreshObject(object *APIObject) (*ControlResult, error) {
+	if root, err := d.getRootObject(); nil != err || root.ObjectID != object.ObjectID {
+		// the shortcut itself is stored, the target is resolved while reading
+		id := object.ObjectID
+		if object, err = d.getObjectFromAPI(id); nil != err {
+			if errors.Is(err, ErrNotFound) {
+				// the object has been deleted in the meantime
+				d.removeFromCache(id)
+			}
+			return nil, err
+		}
+		d.keepExportSize(object)
+		if err := d.cache.UpdateObject(object); nil != err {
+			return nil, err
+		}
+	}
+
+	result := &ControlResult{
+		ObjectID: object.ObjectID,
+		Name:     object.Name,
+		Objects:  1,
+	}
+	if !object.IsDir {
+		return result, nil
+	}
+
+	parent := d.contentID(object.ObjectID)
+	children, err := d.listChildren(parent)
+	if nil != err {
+		// keep the cached children, only the listed ones are known to be current
+		d.cache.BatchUpdateObjects(children)
+		return nil, err
+	}
+	if err := d.cache.BatchUpdateObjects(children); nil != err {
+		return nil, err
+	}
+	result.Objects += len(children)
+
+	cached, err := d.cache.GetObjectsByParent(parent)
+	if nil != err {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(children))
+	for _, child := range children {
+		existing[child.ObjectID] = true
+	}
+	for _, child := range cached {
+		if existing[child.ObjectID] {
+			continue
+		}
+		Log.Debugf("Removing stale object %v (%v) from cache", child.ObjectID, child.Name)
+		if err := d.detachFromParent(child, parent); nil != err {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Invalidate drops the object (a path starting with / or an object id) and all of its
+// children from the cache, they are stored again with the next change of the objects
+func (d *Client) Invalidate(target string) (*ControlResult, error) {
+	object, err := d.resolveTarget(target)
+	if nil != err {
+		return nil, err
+	}
+	if root, err := d.getRootObject(); nil == err && root.ObjectID == object.ObjectID {
+		return nil, fmt.Errorf("Could not invalidate the root object")
+	}
+
+	if err := d.removeFromCache(object.ObjectID); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not remove %v from cache", target)
+	}
+
+	Log.Infof("Invalidated %v", target)
+	return &ControlResult{
+		ObjectID: object.ObjectID,
+		Name:     object.Name,
+		Objects:  1,
+	}, nil
+}
+
+// ResolveTarget gets the object for a path (starting with /) or an object id,
+// shortcuts are resolved to their targets
+func (d *Client) ResolveTarget(target string) (*APIObject, error) {
+	object, err := d.resolveTarget(target)
+	if nil != err {
+		return nil, err
+	}
+	return d.resolveShortcut(object)
+}
+
+// resolveTarget gets the object for a path (starting with /) or an object id,
+// unknown ids are looked up in the API
+func (d *Client) resolveTarget(target string) (*APIObject, error) {
+	if "" == target {
+		return nil, fmt.Errorf("Missing path or object id")
+	}
+	if strings.HasPrefix(target, "/") {
+		return d.GetObjectByPath(target)
+	}
+	if object, err := d.getObjectOrRoot(target); nil == err {
+		return object, nil
+	}
+	return d.getObjectFromAPI(target)
+}
+
+// getObjectFromAPI gets the (not trashed) object from the API
+func (d *Client) getObjectFromAPI(id string) (*APIObject, error) {
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	var file *gdrive.File
+	err = doWithRetry(fmt.Sprintf("get object %v", id), func() error {
+		var err error
+		file, err = client.Files.Get(id).Fields(googleapi.Field(Fields)).SupportsAllDrives(true).Do()
+		return err
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		if isNotFoundError(err) {
+			return nil, fmt.Errorf("Could not find object %v in API: %w", id, ErrNotFound)
+		}
+		return nil, fmt.Errorf("Could not get object %v from API", id)
+	}
+	if file.Trashed || file.ExplicitlyTrashed {
+		return nil, fmt.Errorf("Object %v is trashed: %w", id, ErrNotFound)
+	}
+
+	return d.mapFileToObject(file)
+}
+
+// detachFromParent removes the parent from the object, objects without other
+// parents are removed from the cache with all of their children
+func (d *Client) detachFromParent(object *APIObject, parent string) error {
+	if len(object.Parents) <= 1 {
+		return d.removeFromCache(object.ObjectID)
+	}
+
+	parents := make([]string, 0, len(object.Parents)-1)
+	for _, p := range object.Parents {
+		if p != parent {
+			parents = append(parents, p)
+		}
+	}
+	object.Parents = parents
+	return d.cache.UpdateObject(object)
+}
+
+// ServeControl starts the HTTP listener for the control commands in the background,
+// addresses starting with unix: are served on a Unix socket
+//
+//	POST /refresh?target=/path/or/id
+//	POST /invalidate?target=/path/or/id
+//	POST /link?target=/path/or/id&ttl=30m (only on a Unix socket)
+//	GET  /stats
+func (d *Client) ServeControl(address string) {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+		os.Remove(address)
+	}
+
+	listener, err := net.Listen(network, address)
+	if nil != err {
+		Log.Debugf("%v", err)
+		Log.Errorf("Could not serve control commands on %v", address)
+		return
+	}
+	if "unix" == network {
+		os.Chmod(address, 0600)
+	}
+	Log.Infof("Serving control commands on %v", address)
+
+	mux := d.newControlMux("unix" == network)
+
+	go func() {
+		if err := http.Serve(listener, mux); nil != err && !d.isClosed() {
+			Log.Debugf("%v", err)
+			Log.Errorf("Could not serve control commands on %v", address)
+		}
+	}()
+}
+
+// newControlMux registers the control commands, temporary links grant access to the file
+// content without any authentication so they are only served on a Unix socket
+func (d *Client) newControlMux(unixSocket bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refresh", controlHandler(d.Refresh))
+	mux.HandleFunc("/invalidate", controlHandler(d.Invalidate))
+	if unixSocket {
+		mux.HandleFunc("/link", linkHandler(d.GetTemporaryLink))
+	} else {
+		Log.Infof("Temporary links are only served on a Unix socket control address")
+	}
+	mux.HandleFunc("/stats", statsHandler(d.CacheStats))
+	return mux
+}
+
+// controlHandler runs the command with the target of the request and responds with the result
+func controlHandler(command func(target string) (*ControlResult, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if http.MethodPost != r.Method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(ControlResult{Error: "Only POST is allowed"})
+			return
+		}
+
+		target := r.URL.Query().Get("target")
+		if "" == target {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ControlResult{Error: "Missing target parameter"})
+			return
+		}
+
+		result, err := command(target)
+		if nil != err {
+			Log.Warningf("%v", err)
+			if errors.Is(err, ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			json.NewEncoder(w).Encode(ControlResult{Error: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// linkHandler creates a temporary link for the target and ttl (default 30 minutes) of the request
+func linkHandler(getLink func(target string, ttl time.Duration) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ttl := defaultLinkTTL
+		if value := r.URL.Query().Get("ttl"); "" != value {
+			parsed, err := time.ParseDuration(value)
+			if nil != err || parsed <= 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(ControlResult{Error: fmt.Sprintf("Invalid ttl %v", value)})
+				return
+			}
+			ttl = parsed
+		}
+
+		controlHandler(func(target string) (*ControlResult, error) {
+			link, err := getLink(target, ttl)
+			if nil != err {
+				return nil, err
+			}
+			return &ControlResult{Objects: 1, Link: link}, nil
+		})(w, r)
+	}
+}
+
+// statsHandler responds with the statistics of the metadata cache
+func statsHandler(getStats func() (*CacheStats, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		stats, err := getStats()
+		if nil != err {
+			Log.Warningf("%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ControlResult{Error: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(stats)
+	}
+}
@@ -0,0 +1,133 @@
+package drive
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestInvalidate(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "folder", Name: "Movies", IsDir: true, Parents: []string{"root-id"}},
+		{ObjectID: "child", Name: "movie.mkv", Parents: []string{"folder"}},
+		{ObjectID: "linked", Name: "linked.mkv", Parents: []string{"folder", "other"}},
+	})
+	root := &APIObject{ObjectID: "root-id", IsDir: true}
+	client := &Client{cache: cache, rootNodeID: "root-id", rootObject: root, missingTargets: make(map[string]time.Time)}
+
+	if _, err := client.Invalidate("/"); nil == err {
+		t.Fatalf("Expected the root object not to be invalidated")
+	}
+	if _, err := client.Invalidate("/Movies"); nil != err {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"folder", "child"} {
+		if _, err := cache.GetObject(id); nil == err {
+			t.Fatalf("Expected object %v to be removed from cache", id)
+		}
+	}
+	if object, err := cache.GetObject("linked"); nil != err || 1 != len(object.Parents) {
+		t.Fatalf("Expected object linked to be detached from the folder got %v (%v)", object, err)
+	}
+}
+
+func TestControlHandler(t *testing.T) {
+	handler := controlHandler(func(target string) (*ControlResult, error) {
+		if "/missing" == target {
+			return nil, fmt.Errorf("Could not find %v: %w", target, ErrNotFound)
+		}
+		return &ControlResult{ObjectID: "1", Objects: 1}, nil
+	})
+
+	for _, test := range []struct {
+		method string
+		url    string
+		status int
+	}{
+		{http.MethodGet, "/refresh?target=/movie.mkv", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/refresh", http.StatusBadRequest},
+		{http.MethodPost, "/refresh?target=/missing", http.StatusNotFound},
+		{http.MethodPost, "/refresh?target=/movie.mkv", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(test.method, test.url, nil))
+		if test.status != recorder.Code {
+			t.Fatalf("Expected status %v for %v %v got %v", test.status, test.method, test.url, recorder.Code)
+		}
+	}
+}
+
+func TestGetTemporaryLink(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "folder", Name: "Movies", IsDir: true, Parents: []string{"root-id"}},
+		{ObjectID: "file", Name: "movie.mkv", Parents: []string{"folder"}},
+		{ObjectID: "doc", Name: "notes", Parents: []string{"root-id"}, ExportMimeType: "application/pdf"},
+	})
+	client := &Client{
+		cache:          cache,
+		rootNodeID:     "root-id",
+		rootObject:     &APIObject{ObjectID: "root-id", IsDir: true},
+		missingTargets: make(map[string]time.Time),
+		newTokenSource: func() oauth2.TokenSource {
+			return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret", Expiry: time.Now().Add(time.Hour)})
+		},
+	}
+
+	for target, expected := range map[string]string{
+		"/Movies/movie.mkv": "https://www.googleapis.com/drive/v3/files/file?alt=media&access_token=secret",
+		"doc":               "https://www.googleapis.com/drive/v3/files/doc/export?mimeType=application%2Fpdf&access_token=secret",
+	} {
+		if link, err := client.GetTemporaryLink(target, 10*time.Minute); nil != err || expected != link {
+			t.Fatalf("Expected link %v for %v got %v (%v)", expected, target, link, err)
+		}
+	}
+	if _, err := client.GetTemporaryLink("/Movies", 10*time.Minute); nil == err {
+		t.Fatalf("Expected no link for a folder")
+	}
+	if _, err := client.GetTemporaryLink("file", 2*time.Hour); nil == err {
+		t.Fatalf("Expected no link that outlives the access token")
+	}
+}
+
+func TestLinkHandler(t *testing.T) {
+	handler := linkHandler(func(target string, ttl time.Duration) (string, error) {
+		return fmt.Sprintf("https://example.com/%v?ttl=%v", target, ttl), nil
+	})
+
+	for url, status := range map[string]int{
+		"/link?target=file":             http.StatusOK,
+		"/link?target=file&ttl=5m":      http.StatusOK,
+		"/link?target=file&ttl=forever": http.StatusBadRequest,
+		"/link":                         http.StatusBadRequest,
+	} {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodPost, url, nil))
+		if status != recorder.Code {
+			t.Fatalf("Expected status %v for %v got %v", status, url, recorder.Code)
+		}
+	}
+}
+
+func TestLinkIsOnlyServedOnUnixSocket(t *testing.T) {
+	client := &Client{}
+	for unixSocket, status := range map[bool]int{
+		true:  http.StatusBadRequest,
+		false: http.StatusNotFound,
+	} {
+		recorder := httptest.NewRecorder()
+		client.newControlMux(unixSocket).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/link", nil))
+		if status != recorder.Code {
+			t.Fatalf("Expected status %v for /link (Unix socket %v) got %v", status, unixSocket, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package drive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// tokenKeyMagic starts every token encrypted with a key derived by scrypt, older tokens
+// have been encrypted with the SHA-256 hash of the key and are encrypted again when loaded
+var tokenKeyMagic = []byte("plexdrive-token-v2\x00")
+
+// The parameters of the key derivation (the recommended work factor for interactive logins)
+const (
+	tokenSaltSize = 16
+	scryptN       = 32768
+	scryptR       = 8
+	scryptP       = 1
+)
+
+// newTokenCipher creates the AES-GCM cipher for the token file with the derived key
+func newTokenCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveTokenKey derives the AES key from the passphrase / key file content and the salt
+func deriveTokenKey(key, salt []byte) ([]byte, error) {
+	return scrypt.Key(key, salt, scryptN, scryptR, scryptP, 32)
+}
+
+// encryptToken encrypts the token content with a key derived from a new random salt,
+// the salt and the nonce are stored in front of the result
+func encryptToken(key, plaintext []byte) ([]byte, error) {
+	salt := make([]byte, tokenSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); nil != err {
+		return nil, err
+	}
+	derived, err := deriveTokenKey(key, salt)
+	if nil != err {
+		return nil, err
+	}
+	gcm, err := newTokenCipher(derived)
+	if nil != err {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); nil != err {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, tokenKeyMagic...), salt...), nonce...)
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// decryptToken decrypts the token content encrypted by encryptToken, legacy is set
+// when the token has been encrypted with the SHA-256 hash of the key
+func decryptToken(key, ciphertext []byte) (plaintext []byte, legacy bool, err error) {
+	derived := []byte(nil)
+	if bytes.HasPrefix(ciphertext, tokenKeyMagic) {
+		ciphertext = ciphertext[len(tokenKeyMagic):]
+		if len(ciphertext) < tokenSaltSize {
+			return nil, false, fmt.Errorf("Encrypted token is too short")
+		}
+		derived, err = deriveTokenKey(key, ciphertext[:tokenSaltSize])
+		if nil != err {
+			return nil, false, err
+		}
+		ciphertext = ciphertext[tokenSaltSize:]
+	} else {
+		hash := sha256.Sum256(key)
+		derived = hash[:]
+		legacy = true
+	}
+
+	gcm, err := newTokenCipher(derived)
+	if nil != err {
+		return nil, false, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, false, fmt.Errorf("Encrypted token is too short")
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	plaintext, err = gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], nil)
+	return plaintext, legacy, err
+}
@@ -0,0 +1,48 @@
+package drive
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// degradedAfter is the number of change checks in a row that have to fail before
+// the client only serves from the cache
+const degradedAfter = 2
+
+// ErrDegraded is returned for operations that need Google Drive while it is unreachable
+var ErrDegraded = errors.New("Google Drive is unreachable, serving from cache only")
+
+// recordChangeCheck switches to the cache-only mode after repeated failed change checks
+// and back again as soon as a change check succeeds, the last error is kept for the account status
+func (d *Client) recordChangeCheck(err error) {
+	d.degradedLock.Lock()
+	defer d.degradedLock.Unlock()
+
+	if nil == err {
+		if !d.degradedSince.IsZero() {
+			Log.Infof("Google Drive is reachable again after %v, leaving cache-only mode",
+				time.Since(d.degradedSince).Round(time.Second))
+		}
+		d.failedChecks = 0
+		d.degradedSince = time.Time{}
+		return
+	}
+
+	d.failedChecks++
+	d.lastError = err.Error()
+	d.lastErrorAt = time.Now()
+	if d.failedChecks >= degradedAfter && d.degradedSince.IsZero() {
+		Log.Warningf("Google Drive is unreachable, serving from cache only until it is reachable again")
+		d.degradedSince = time.Now()
+	}
+}
+
+// IsDegraded checks if the client only serves from the cache because Google Drive is unreachable,
+// objects that are not cached yet (e.g. shortcut targets or export sizes) are not fetched meanwhile
+func (d *Client) IsDegraded() bool {
+	d.degradedLock.Lock()
+	defer d.degradedLock.Unlock()
+	return !d.degradedSince.IsZero()
+}
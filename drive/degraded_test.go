@@ -0,0 +1,54 @@
+package drive
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDegradedAfterFailedChangeChecks(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+	client := &Client{cache: cache, missingTargets: make(map[string]time.Time)}
+
+	client.recordChangeCheck(errors.New("network is unreachable"))
+	if client.IsDegraded() {
+		t.Fatalf("Expected a single failed check not to degrade the client")
+	}
+	client.recordChangeCheck(errors.New("network is unreachable"))
+	if !client.IsDegraded() {
+		t.Fatalf("Expected repeated failed checks to degrade the client")
+	}
+
+	// nothing that isn't cached is fetched from the API meanwhile
+	if _, err := client.getShortcutTarget("target"); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("Expected the shortcut target not to be fetched got %v", err)
+	}
+	if _, err := client.GetExportSize(&APIObject{ObjectID: "doc", ExportMimeType: "application/pdf"}); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("Expected the export size not to be fetched got %v", err)
+	}
+	if _, missing := client.missingTargets["target"]; missing {
+		t.Fatalf("Expected the shortcut target not to be remembered as missing")
+	}
+
+	client.recordChangeCheck(nil)
+	if client.IsDegraded() {
+		t.Fatalf("Expected a successful check to end the cache-only mode")
+	}
+}
+
+func TestFailedChangeStoreIsRecorded(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+	client := newTestClient(cache, func(r *http.Request) (int, string) {
+		return 200, `{"newStartPageToken": "2", "changes": []}`
+	})
+
+	// the changes can't be stored in a closed cache
+	cache.Close()
+	client.checkChanges(false)
+	if 1 != client.failedChecks || "" == client.lastError {
+		t.Fatalf("Expected the failed store to be recorded got %v (%v)", client.failedChecks, client.lastError)
+	}
+}
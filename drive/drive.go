@@ -2,41 +2,175 @@ package drive
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	. "github.com/claudetech/loggo/default"
 	"github.com/dweidenfeld/plexdrive/config"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	gdrive "google.golang.org/api/drive/v3"
 	"google.golang.org/api/googleapi"
 )
 
-// Fields are the fields that should be returned by the Google Drive API
+// uploadChunkSize is the size of the chunks of a resumable upload
+const uploadChunkSize = 8 * 1024 * 1024
+
+// minRefreshInterval is the lowest allowed interval between two change checks
+const minRefreshInterval = 1 * time.Minute
+
+// refreshJitter is the maximum share of the refresh interval that is randomly added to every wait,
+// so that several plexdrive instances don't all check for changes at the same moment
+const refreshJitter = 0.1
+
+// SharedFolderID is the id of the virtual folder that contains all objects without a parent
+const SharedFolderID = "plexdrive-shared"
+
+// sharedFolderName is the name of the virtual shared folder in the root folder
+const sharedFolderName = "Shared"
+
+// TrashFolderID is the id of the virtual folder that contains all trashed objects
+const TrashFolderID = "plexdrive-trash"
+
+// trashFolderName is the name of the virtual trash folder in the root folder
+const trashFolderName = ".Trash"
+
+// ShowTrash keeps trashed objects in the cache and shows them in the trash folder
+var ShowTrash bool
+
+// The timestamps of a file that can be used as modification time
+const (
+	MTimeModified = "modified"
+	MTimeCreated  = "created"
+	MTimeViewed   = "viewed"
+	MTimeNewest   = "newest"
+)
+
+// MTimeSource is the timestamp of the files that is used as modification time
+var MTimeSource = MTimeModified
+
+// CaseInsensitive finds objects by name ignoring the case when there is no exact match
+var CaseInsensitive bool
+
+// ErrNotFound is returned when an object could not be found
+var ErrNotFound = errors.New("Object not found")
+
+// ErrCrossDriveMove is returned when an object should be moved to another (shared) drive
+var ErrCrossDriveMove = errors.New("Objects can't be moved between different drives")
+
+// ErrReadOnly is returned for write operations when the client is read only
+var ErrReadOnly = errors.New("Plexdrive is running in read only mode")
+
+// ErrIncompleteListing is returned with the objects listed so far when a page of a listing
+// could not be fetched, the listing must not be treated as complete
+var ErrIncompleteListing = errors.New("Listing is incomplete")
+
+// PageSize is the number of results requested per page when listing changes and folders
+// (the API allows at most 1000, fewer results per page are handled by following the page tokens)
+var PageSize int64 = 1000
+
+// Fields are the fields that should be returned by the Google Drive API (only the
+// fields read by mapFileToObject, all other fields are dropped from the responses)
 var Fields string
 
 // init initializes the global configurations
 func init() {
-	Fields = "id, name, mimeType, modifiedTime, size, explicitlyTrashed, parents, capabilities/canTrash"
+	Fields = "id, name, mimeType, modifiedTime, createdTime, viewedByMeTime, spaces, size, md5Checksum, trashed, explicitlyTrashed, parents, driveId, capabilities/canTrash, shortcutDetails(targetId, targetMimeType), videoMediaMetadata(width, height, durationMillis)"
 }
 
 // Client holds the Google Drive API connection(s)
 type Client struct {
-	cache           *Cache
-	context         context.Context
-	token           *oauth2.Token
-	config          *oauth2.Config
-	rootNodeID      string
-	driveID         string
-	changesChecking bool
+	cache              Cache
+	context            context.Context
+	token              *oauth2.Token
+	tokenSource        oauth2.TokenSource
+	newTokenSource     func() oauth2.TokenSource
+	config             *oauth2.Config
+	serviceAccountFile string
+	subject            string
+	rootNodeID         string
+	rootObject         *APIObject
+	rootLock           sync.Mutex
+	driveID            string
+	deletePermanently  bool
+	authPort           int
+	readOnly           bool
+	requestTimeout     time.Duration
+	metadataTimeout    time.Duration
+	readIdleTimeout    time.Duration
+	changesChecking    bool
+	changesLock        sync.Mutex
+	lastRefresh        time.Time
+	warmChanged        map[string]time.Time
+	warmLock           sync.Mutex
+	health             Health
+	healthLock         sync.Mutex
+	missingTargets     map[string]time.Time
+	shortcutLock       sync.Mutex
+	revisions          map[string]cachedRevisions
+	revisionsLock      sync.Mutex
+	ttls               map[string]objectTTL
+	revalidating       map[string]bool
+	ttlLock            sync.Mutex
+	failedChecks       int
+	degradedSince      time.Time
+	lastError          string
+	lastErrorAt        time.Time
+	degradedLock       sync.Mutex
+	revokedAt          time.Time
+	authLock           sync.Mutex
+	stop               chan struct{}
+	stopOnce           sync.Once
+	watching           sync.WaitGroup
 }
 
 // NewClient creates a new Google Drive client
-func NewClient(config *config.Config, cache *Cache, refreshInterval time.Duration, rootNodeID string, driveID string) (*Client, error) {
+func NewClient(config *config.Config, cache Cache, refreshInterval time.Duration, rootNodeID string, driveID string, deletePermanently bool, authPort int, readOnly bool, httpOptions HTTPOptions) (*Client, error) {
+	if refreshInterval < minRefreshInterval {
+		Log.Warningf("Refresh interval %v is too low, using %v instead", refreshInterval, minRefreshInterval)
+		refreshInterval = minRefreshInterval
+	}
+
+	client, err := newClient(config, cache, rootNodeID, driveID, deletePermanently, authPort, readOnly, httpOptions)
+	if nil != err {
+		return nil, err
+	}
+
+	client.watching.Add(1)
+	go client.startWatchChanges(refreshInterval)
+
+	return client, nil
+}
+
+// newClient creates and authorizes a Google Drive client without watching for changes
+func newClient(config *config.Config, cache Cache, rootNodeID string, driveID string, deletePermanently bool, authPort int, readOnly bool, httpOptions HTTPOptions) (*Client, error) {
+	ctx, err := newHTTPContext(httpOptions)
+	if nil != err {
+		return nil, err
+	}
+
+	scope := gdrive.DriveScope
+	if readOnly {
+		scope = gdrive.DriveReadonlyScope
+	}
+	scopes := []string{scope}
+	if hasSpace(SpacePhotos) {
+		// the photos space is only listed with its own scope
+		scopes = append(scopes, gdrive.DrivePhotosReadonlyScope)
+	}
+
 	client := Client{
 		cache:   cache,
-		context: context.Background(),
+		context: ctx,
 		config: &oauth2.Config{
 			ClientID:     config.ClientID,
 			ClientSecret: config.ClientSecret,
@@ -45,11 +179,21 @@ func NewClient(config *config.Config, cache *Cache, refreshInterval time.Duratio
 				TokenURL: "https://accounts.google.com/o/oauth2/token",
 			},
 			RedirectURL: "urn:ietf:wg:oauth:2.0:oob",
-			Scopes:      []string{gdrive.DriveScope},
+			Scopes:      scopes,
 		},
-		rootNodeID:      rootNodeID,
-		driveID:         driveID,
-		changesChecking: false,
+		serviceAccountFile: config.ServiceAccountFile,
+		subject:            config.Subject,
+		rootNodeID:         rootNodeID,
+		driveID:            driveID,
+		deletePermanently:  deletePermanently,
+		authPort:           authPort,
+		readOnly:           readOnly,
+		requestTimeout:     httpOptions.RequestTimeout,
+		metadataTimeout:    httpOptions.MetadataTimeout,
+		readIdleTimeout:    httpOptions.ReadIdleTimeout,
+		changesChecking:    false,
+		missingTargets:     make(map[string]time.Time),
+		stop:               make(chan struct{}),
 	}
 
 	if "" == client.rootNodeID {
@@ -63,33 +207,81 @@ func NewClient(config *config.Config, cache *Cache, refreshInterval time.Duratio
 		return nil, err
 	}
 
-	go client.startWatchChanges(refreshInterval)
-
 	return &client, nil
 }
 
+// Close stops watching for changes and waits until a running change check is finished,
+// so that no cache writes are pending when the cache is closed
+func (d *Client) Close() error {
+	d.stopOnce.Do(func() {
+		Log.Debugf("Stopping to watch for changes")
+		close(d.stop)
+	})
+	d.watching.Wait()
+	return nil
+}
+
+// isClosed checks if the client has been closed
+func (d *Client) isClosed() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 func (d *Client) startWatchChanges(refreshInterval time.Duration) {
+	defer d.watching.Done()
+
+	if err := d.storeCacheSource(); nil != err {
+		Log.Warningf("%v", err)
+	}
+	if nil != Replica {
+		// fill an empty cache from the replica, the changes are scanned from the beginning otherwise
+		if err := d.fillFromReplica(Replica); nil != err {
+			Log.Warningf("%v", err)
+			Log.Warningf("Could not fill the cache from the replica, building it from Google Drive")
+		}
+		Replica.Close()
+	}
+
 	d.checkChanges(true)
-	for _ = range time.Tick(refreshInterval) {
-		d.checkChanges(false)
+
+	timer := time.NewTimer(jitterInterval(refreshInterval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			d.checkChanges(false)
+			timer.Reset(jitterInterval(refreshInterval))
+		case <-d.stop:
+			return
+		}
 	}
 }
 
+// jitterInterval adds a random offset of up to refreshJitter of the interval
+func jitterInterval(interval time.Duration) time.Duration {
+	return interval + time.Duration(rand.Float64()*refreshJitter*float64(interval))
+}
+
 func (d *Client) checkChanges(firstCheck bool) {
+	d.changesLock.Lock()
 	if d.changesChecking {
+		d.changesLock.Unlock()
 		return
 	}
 	d.changesChecking = true
+	d.changesLock.Unlock()
+	defer func() {
+		d.changesLock.Lock()
+		d.changesChecking = false
+		d.changesLock.Unlock()
+	}()
 
 	Log.Debugf("Checking for changes")
 
-	client, err := d.getClient()
-	if nil != err {
-		Log.Debugf("%v", err)
-		Log.Warningf("Could not get Google Drive client to watch for changes")
-		return
-	}
-
 	// get the last token
 	pageToken, err := d.cache.GetStartPageToken()
 	if nil != err {
@@ -106,88 +298,159 @@ func (d *Client) checkChanges(firstCheck bool) {
 	deletedItems := 0
 	updatedItems := 0
 	processedItems := 0
-	for {
-		query := client.Changes.
-			List(pageToken).
-			Fields(googleapi.Field(fmt.Sprintf("nextPageToken, newStartPageToken, changes(changeType, removed, fileId, file(%v))", Fields))).
-			PageSize(1000).
-			SupportsAllDrives(true).
-			IncludeItemsFromAllDrives(true).
-			IncludeCorpusRemovals(true)
-
-		if d.driveID != "" {
-			query = query.TeamDriveId(d.driveID)
-		}
-
-		results, err := query.Do()
+	// completed is only set with the last page, an error or Close stop the loop before
+	completed := false
+	for !d.isClosed() {
+		objects, deletedIDs, nextPageToken, newStartPageToken, err := d.getChanges(pageToken)
 		if nil != err {
-			Log.Debugf("%v", err)
-			Log.Warningf("Could not get changes")
+			// the processed pages are stored, the next check continues with the failed page
+			Log.Warningf("%v", err)
+			Log.Warningf("Could not get all changes, continuing with the next check")
+			d.recordChangeCheck(err)
 			break
 		}
 
-		objects := make([]*APIObject, 0)
-		for _, change := range results.Changes {
-			Log.Tracef("Change %v", change)
-			// ignore changes for changeType drive
-			if change.ChangeType != "file" {
-				Log.Warningf("Ignoring change type %v", change.ChangeType)
-				continue
-			}
-
-			if change.Removed || (nil != change.File && change.File.ExplicitlyTrashed) {
-				if err := d.cache.DeleteObject(change.FileId); nil != err {
-					Log.Tracef("%v", err)
-				}
-				deletedItems++
-			} else {
-				object, err := d.mapFileToObject(change.File)
-				if nil != err {
-					Log.Debugf("%v", err)
-					Log.Warningf("Could not map Google Drive file %v (%v) to object", change.File.Id, change.File.Name)
-				} else {
-					objects = append(objects, object)
-					updatedItems++
-				}
-			}
-
-			processedItems++
+		for _, object := range objects {
+			d.keepExportSize(object)
+		}
+		token := nextPageToken
+		if "" == token {
+			token = newStartPageToken
 		}
-		if err := d.cache.BatchUpdateObjects(objects); nil != err {
+		// the whole page is stored in one transaction, the token is only advanced with the page
+		if err := d.applyChanges(objects, deletedIDs, token); nil != err {
 			Log.Warningf("%v", err)
-			return
+			Log.Warningf("Could not store the changes, continuing with the next check")
+			d.recordChangeCheck(err)
+			break
 		}
+		deletedItems += len(deletedIDs)
+		updatedItems += len(objects)
+		processedItems += len(deletedIDs) + len(objects)
 
-		if processedItems > 0 {
+		// only the first cache build is reported, regular updates would flood the logs
+		if firstCheck && processedItems > 0 {
 			Log.Infof("Processed %v items / deleted %v items / updated %v items",
 				processedItems, deletedItems, updatedItems)
+		} else if processedItems > 0 {
+			Log.Debugf("Processed %v items / deleted %v items / updated %v items",
+				processedItems, deletedItems, updatedItems)
 		}
 
-		if "" != results.NextPageToken {
-			pageToken = results.NextPageToken
-			d.cache.StoreStartPageToken(pageToken)
-		} else {
-			pageToken = results.NewStartPageToken
-			d.cache.StoreStartPageToken(pageToken)
+		pageToken = token
+		if "" == nextPageToken {
+			d.changesLock.Lock()
+			d.lastRefresh = time.Now()
+			d.changesLock.Unlock()
+			d.recordChangeCheck(nil)
+			completed = true
 			break
 		}
 	}
 
-	if firstCheck {
+	if firstCheck && completed {
 		Log.Infof("First cache build process finished!")
+	} else if firstCheck {
+		Log.Warningf("First cache build process is incomplete, it is resumed with the next check")
+	}
+}
+
+// GetChanges gets one page of changes starting at the page token, it returns the changed objects,
+// the ids of removed or trashed (unless ShowTrash is set) objects and the token to
+// continue with (the start page token for future changes once all changes have been returned)
+func (d *Client) GetChanges(pageToken string) ([]*APIObject, []string, string, error) {
+	objects, deletedIDs, nextPageToken, newStartPageToken, err := d.getChanges(pageToken)
+	if nil != err {
+		return nil, nil, "", err
+	}
+	if "" == nextPageToken {
+		nextPageToken = newStartPageToken
+	}
+	return objects, deletedIDs, nextPageToken, nil
+}
+
+// getChanges gets one page of changes, either the next page token (more changes are
+// available) or the new start page token (all changes have been returned) is set
+func (d *Client) getChanges(pageToken string) ([]*APIObject, []string, string, string, error) {
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, nil, "", "", fmt.Errorf("Could not get Google Drive client to get changes")
+	}
+
+	query := client.Changes.
+		List(pageToken).
+		Fields(googleapi.Field(fmt.Sprintf("nextPageToken, newStartPageToken, changes(changeType, removed, fileId, file(%v))", Fields))).
+		PageSize(PageSize).
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true).
+		IncludeCorpusRemovals(true)
+
+	if d.driveID != "" {
+		query = query.DriveId(d.driveID)
+	}
+	if "" != Spaces {
+		query = query.Spaces(Spaces)
+	}
+
+	var results *gdrive.ChangeList
+	err = doWithRetry(fmt.Sprintf("get changes of page %v", pageToken), func() error {
+		var err error
+		results, err = query.Do()
+		return err
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, nil, "", "", fmt.Errorf("Could not get changes of page %v", pageToken)
+	}
+
+	objects := make([]*APIObject, 0)
+	deletedIDs := make([]string, 0)
+	for _, change := range results.Changes {
+		Log.Tracef("Change %v", change)
+		// ignore changes for changeType drive
+		if change.ChangeType != "file" {
+			Log.Debugf("Ignoring change type %v", change.ChangeType)
+			continue
+		}
+
+		if change.Removed || (!ShowTrash && nil != change.File && (change.File.Trashed || change.File.ExplicitlyTrashed)) {
+			deletedIDs = append(deletedIDs, change.FileId)
+			continue
+		}
+
+		// excluded objects are stored as well, they are only hidden in the listings so
+		// that they show up again once the filters are changed
+		object, err := d.mapFileToObject(change.File)
+		if nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not map Google Drive file %v (%v) to object", change.File.Id, change.File.Name)
+		} else {
+			objects = append(objects, object)
+		}
 	}
 
-	d.changesChecking = false
+	return objects, deletedIDs, results.NextPageToken, results.NewStartPageToken, nil
 }
 
 func (d *Client) authorize() error {
 	Log.Debugf("Authorizing against Google Drive API")
 
+	if "" != d.serviceAccountFile {
+		return d.authorizeServiceAccount()
+	}
+
 	token, err := d.cache.LoadToken()
+	for _, scope := range d.config.Scopes {
+		if nil == err && !hasScope(token, scope) {
+			Log.Warningf("The stored token was not granted the scope %v, please authorize again", scope)
+			err = fmt.Errorf("Token scope %v does not match", tokenScope(token))
+		}
+	}
 	if nil != err {
 		Log.Debugf("Token could not be found, fetching new one")
 
-		t, err := getTokenFromWeb(d.config)
+		t, err := getTokenFromWeb(d.context, d.config, d.authPort)
 		if nil != err {
 			return err
 		}
@@ -197,13 +460,108 @@ func (d *Client) authorize() error {
 		}
 	}
 
+	d.setToken(token)
+
+	// validate the token now, otherwise a revoked token only shows up as failing reads
+	if err := d.checkAuthorization(); nil != err {
+		if !isAuthError(err) {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not validate the stored token, continuing anyway")
+			return nil
+		}
+
+		Log.Debugf("%v", err)
+		Log.Warningf("The stored token for client %v is not valid anymore (access revoked or client changed), please authorize again", d.config.ClientID)
+		token, err := getTokenFromWeb(d.context, d.config, d.authPort)
+		if nil != err {
+			return err
+		}
+		if err := d.cache.StoreToken(token); nil != err {
+			return err
+		}
+		d.setToken(token)
+	}
+	return nil
+}
+
+// setToken uses the token for all API calls (refreshed tokens are stored in the cache)
+func (d *Client) setToken(token *oauth2.Token) {
 	d.token = token
+	d.tokenSource = &revocationTokenSource{
+		source: oauth2.ReuseTokenSource(token, &storingTokenSource{
+			source: d.config.TokenSource(d.context, token),
+			cache:  d.cache,
+			token:  token,
+		}),
+		client: d,
+	}
+	d.newTokenSource = func() oauth2.TokenSource {
+		return d.config.TokenSource(d.context, &oauth2.Token{RefreshToken: token.RefreshToken})
+	}
+}
+
+// checkAuthorization does a cheap API call to check that the token is accepted
+func (d *Client) checkAuthorization() error {
+	client, err := d.getClient()
+	if nil != err {
+		return err
+	}
+
+	return doWithRetry("check the authorization", func() error {
+		_, err := client.About.Get().Fields("user").Do()
+		return err
+	})
+}
+
+// authorizeServiceAccount authorizes with a service account JSON key
+// (impersonating the configured subject when domain-wide delegation is used)
+func (d *Client) authorizeServiceAccount() error {
+	Log.Debugf("Authorizing with service account %v", d.serviceAccountFile)
+
+	keyJSON, err := ioutil.ReadFile(d.serviceAccountFile)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read service account file %v", d.serviceAccountFile)
+	}
+
+	jwtConfig, err := google.JWTConfigFromJSON(keyJSON, d.config.Scopes...)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not parse service account file %v", d.serviceAccountFile)
+	}
+	jwtConfig.Subject = d.subject
+
+	d.tokenSource = &revocationTokenSource{source: jwtConfig.TokenSource(d.context), client: d}
+	d.newTokenSource = func() oauth2.TokenSource {
+		return jwtConfig.TokenSource(d.context)
+	}
+
+	if err := d.checkAuthorization(); nil != err && isAuthError(err) {
+		Log.Debugf("%v", err)
+		if "" != d.subject && isDelegationError(err) {
+			return fmt.Errorf("Service account %v is not allowed to impersonate %v, enable domain-wide delegation for its client id with the scope %v in the Admin console",
+				jwtConfig.Email, d.subject, strings.Join(d.config.Scopes, ","))
+		}
+		return fmt.Errorf("Service account %v was rejected by Google Drive", d.serviceAccountFile)
+	}
+	if "" != d.subject {
+		Log.Infof("Impersonating %v with service account %v", d.subject, jwtConfig.Email)
+	}
 	return nil
 }
 
 // getTokenFromWeb uses Config to request a Token.
 // It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config, authPort int) (*oauth2.Token, error) {
+	if authPort >= 0 {
+		token, err := getTokenFromLoopback(ctx, config, authPort)
+		if nil == err {
+			return token, nil
+		}
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not receive the authorization code on a local port, falling back to pasting the code")
+	}
+
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Printf("Go to the following link in your browser %v\n", authURL)
 	fmt.Printf("Paste the authorization code: ")
@@ -213,21 +571,140 @@ func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 		return nil, fmt.Errorf("Unable to read authorization code %v", err)
 	}
 
-	tok, err := config.Exchange(oauth2.NoContext, code)
+	tok, err := config.Exchange(ctx, code)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to retrieve token from web %v", err)
 	}
 	return tok, err
 }
 
-// getClient gets a new Google Drive client
+// IsReadOnly checks if write operations are rejected
+func (d *Client) IsReadOnly() bool {
+	return d.readOnly
+}
+
+// checkWritable returns ErrReadOnly when the client is read only
+func (d *Client) checkWritable(action string, ids ...string) error {
+	if d.readOnly {
+		return fmt.Errorf("Could not %v: %w", action, ErrReadOnly)
+	}
+	for _, id := range ids {
+		if isVersionID(id) {
+			return fmt.Errorf("Could not %v, versions are read only: %w", action, ErrReadOnly)
+		}
+	}
+	return nil
+}
+
+// HTTPOptions configures the HTTP connections to Google Drive
+type HTTPOptions struct {
+	// ProxyURL is the proxy all traffic is sent through (http, https or socks5, with optional credentials)
+	ProxyURL string
+	// ResponseHeaderTimeout is the time to wait for the response headers (0 = no timeout)
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout is the time an idle connection is kept open for reuse (0 = no limit)
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is the number of idle connections kept open to each host
+	MaxIdleConnsPerHost int
+	// RequestTimeout is the maximum duration of a whole download including reading the body (0 = no timeout)
+	RequestTimeout time.Duration
+	// MetadataTimeout is the maximum duration of an API call, e.g. listing a folder (0 = RequestTimeout)
+	MetadataTimeout time.Duration
+	// ReadIdleTimeout aborts downloads that haven't received any data for this time (0 = no timeout)
+	ReadIdleTimeout time.Duration
+	// UserAgent replaces the default User-Agent of all requests (empty = default)
+	UserAgent string
+	// QuotaProject is the Google Cloud project the API usage is billed to (empty = project of the client id)
+	QuotaProject string
+}
+
+// headerTransport sets the User-Agent and the quota project header on all requests
+type headerTransport struct {
+	transport    http.RoundTripper
+	userAgent    string
+	quotaProject string
+}
+
+// RoundTrip sets the headers on a copy of the request and sends it with the underlying transport
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if "" != t.userAgent {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	// the quota project is only known to the APIs, not to the OAuth endpoints
+	if "" != t.quotaProject && strings.HasSuffix(req.URL.Hostname(), "googleapis.com") {
+		req.Header.Set("X-Goog-User-Project", t.quotaProject)
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// newHTTPContext creates the context for all API and download requests,
+// the http client stored in the context uses the configured transport
+func newHTTPContext(options HTTPOptions) (context.Context, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+	transport.IdleConnTimeout = options.IdleConnTimeout
+	transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+
+	if "" != options.ProxyURL {
+		proxy, err := url.Parse(options.ProxyURL)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not parse proxy url %v", options.ProxyURL)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("Proxy scheme %v is not supported (use http, https or socks5)", proxy.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if "" != options.UserAgent || "" != options.QuotaProject {
+		roundTripper = &headerTransport{
+			transport:    transport,
+			userAgent:    options.UserAgent,
+			quotaProject: options.QuotaProject,
+		}
+	}
+
+	return context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
+		Transport: roundTripper,
+		Timeout:   options.RequestTimeout,
+	}), nil
+}
+
+// getClient gets a new Google Drive client, its API calls are limited by the metadata timeout
 func (d *Client) getClient() (*gdrive.Service, error) {
-	return gdrive.New(d.config.Client(d.context, d.token))
+	client := oauth2.NewClient(d.context, d.tokenSource)
+	client.Timeout = d.requestTimeout
+	if d.metadataTimeout > 0 {
+		client.Timeout = d.metadataTimeout
+	}
+	return gdrive.New(client)
+}
+
+// getUploadClient gets the Google Drive client for uploads, every chunk of an upload may take
+// up to the request timeout (the metadata timeout would abort chunks on slow uplinks)
+func (d *Client) getUploadClient() (*gdrive.Service, error) {
+	client := oauth2.NewClient(d.context, d.tokenSource)
+	client.Timeout = d.requestTimeout
+	return gdrive.New(client)
 }
 
-// GetNativeClient gets a native http client
+// GetNativeClient gets a native http client for downloads, idle downloads are aborted
+// after the read idle timeout
 func (d *Client) GetNativeClient() *http.Client {
-	return oauth2.NewClient(d.context, d.config.TokenSource(d.context, d.token))
+	client := oauth2.NewClient(d.context, d.tokenSource)
+	client.Timeout = d.requestTimeout
+	if d.readIdleTimeout > 0 {
+		client.Transport = &idleTimeoutTransport{
+			transport: client.Transport,
+			timeout:   d.readIdleTimeout,
+		}
+	}
+	return client
 }
 
 // GetRoot gets the root node directly from the API
@@ -240,46 +717,281 @@ func (d *Client) GetRoot() (*APIObject, error) {
 		return nil, fmt.Errorf("Could not get Google Drive client")
 	}
 
-	file, err := client.Files.
-		Get(d.rootNodeID).
-		Fields(googleapi.Field(Fields)).
-		SupportsAllDrives(true).
-		Do()
+	var file *gdrive.File
+	err = doWithRetry(fmt.Sprintf("get root object %v", d.rootNodeID), func() error {
+		var err error
+		file, err = client.Files.
+			Get(d.rootNodeID).
+			Fields(googleapi.Field(Fields)).
+			SupportsAllDrives(true).
+			Do()
+		return err
+	})
 	if nil != err {
 		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not get object %v from API", d.rootNodeID)
-	}
-
-	// getting file size
-	if file.MimeType != "application/vnd.google-apps.folder" && 0 == file.Size {
-		res, err := client.Files.Get(d.rootNodeID).SupportsAllDrives(true).Download()
-		if nil != err {
-			Log.Debugf("%v", err)
-			return nil, fmt.Errorf("Could not get file size for object %v", d.rootNodeID)
+		if isNotFoundError(err) {
+			return nil, fmt.Errorf("Could not find object %v in API: %w", d.rootNodeID, ErrNotFound)
 		}
-		file.Size = res.ContentLength
+		return nil, fmt.Errorf("Could not get object %v from API", d.rootNodeID)
 	}
 
+	// the size is part of the metadata for all binary files, the size of native
+	// Google Docs files is determined (and cached) by GetExportSize when it's needed
 	return d.mapFileToObject(file)
 }
 
 // GetObject gets an object by id
 func (d *Client) GetObject(id string) (*APIObject, error) {
-	return d.cache.GetObject(id)
+	object, err := d.cache.GetObject(id)
+	if nil != err {
+		return nil, err
+	}
+	d.checkStale(object)
+	return object, nil
+}
+
+// GetObjects gets multiple objects by their ids
+func (d *Client) GetObjects(ids []string) ([]*APIObject, error) {
+	return d.cache.GetObjects(ids)
 }
 
 // GetObjectsByParent get all objects under parent id
 func (d *Client) GetObjectsByParent(parent string) ([]*APIObject, error) {
-	return d.cache.GetObjectsByParent(parent)
+	if isVersionID(parent) {
+		return d.getVersionObjects(parent)
+	}
+	if err := d.checkFolder(parent); nil != err {
+		return nil, err
+	}
+	d.checkStaleID(parent)
+
+	objects, err := d.cache.GetObjectsByParent(d.contentID(parent))
+	if nil != err {
+		return nil, err
+	}
+	objects = renameDuplicates(filterObjects(d.resolveShortcuts(objects)))
+
+	for _, folder := range d.getVirtualFolders(parent) {
+		exists := false
+		for _, object := range objects {
+			if object.Name == folder.Name {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			objects = append(objects, folder)
+		}
+	}
+
+	return objects, nil
+}
+
+// checkFolder checks that the folder still exists (cache first), so that a removed folder
+// isn't listed as an empty folder
+func (d *Client) checkFolder(id string) error {
+	if SharedFolderID == id || TrashFolderID == id {
+		return nil
+	}
+
+	object, err := d.cache.GetObject(id)
+	if errors.Is(err, ErrNotFound) {
+		if root, rootErr := d.getRootObject(); nil == rootErr && root.ObjectID == id {
+			return nil
+		}
+		return fmt.Errorf("Could not find folder %v: %w", id, ErrNotFound)
+	}
+	if nil != err {
+		return err
+	}
+	if !object.IsDir {
+		return fmt.Errorf("Object %v (%v) is not a folder: %w", object.ObjectID, object.Name, ErrNotFound)
+	}
+	return nil
 }
 
 // GetObjectByParentAndName finds a child element by name and its parent id
 func (d *Client) GetObjectByParentAndName(parent, name string) (*APIObject, error) {
-	return d.cache.GetObjectByParentAndName(parent, name)
+	if isVersionID(parent) {
+		return d.getVersionChild(parent, name)
+	}
+	object, err := d.getChild(parent, name)
+	if errors.Is(err, ErrNotFound) {
+		for _, folder := range d.getVirtualFolders(parent) {
+			if folder.Name == name || (CaseInsensitive && strings.EqualFold(folder.Name, name)) {
+				return folder, nil
+			}
+		}
+	}
+	return object, err
+}
+
+// getVirtualFolders gets the virtual shared, trash and versions folders shown in the parent
+func (d *Client) getVirtualFolders(parent string) []*APIObject {
+	folders := make([]*APIObject, 0, 3)
+	if shared := d.getSharedFolder(parent); nil != shared {
+		folders = append(folders, shared)
+	}
+	if trash := d.getTrashFolder(parent); nil != trash {
+		folders = append(folders, trash)
+	}
+	if versions := d.getVersionsFolder(parent); nil != versions {
+		folders = append(folders, versions)
+	}
+	return folders
+}
+
+// getChild gets a child from the cache (with resolved shortcuts), excluded children are not found
+func (d *Client) getChild(parent, name string) (*APIObject, error) {
+	object, err := d.cache.GetObjectByParentAndName(d.contentID(parent), name)
+	if errors.Is(err, ErrNotFound) {
+		object, err = d.getDuplicateChild(parent, name)
+	}
+	if errors.Is(err, ErrNotFound) && CaseInsensitive {
+		object, err = d.getChildIgnoringCase(parent, name)
+	}
+	if nil != err {
+		return nil, err
+	}
+	d.checkStale(object)
+	if object, err = d.resolveShortcut(object); nil != err {
+		return nil, err
+	}
+	if isExcluded(object) {
+		// a duplicate keeps the name if its namesake with the lower id is excluded
+		if listed, err := d.getListedChild(parent, name); nil == err {
+			return listed, nil
+		}
+		return nil, fmt.Errorf("Object %v in parent %v is excluded: %w", name, parent, ErrNotFound)
+	}
+	return object, nil
+}
+
+// getChildIgnoringCase gets a child from the cache whose name only differs in case, the
+// one with the lowest id is used when several children match (the same one every time)
+func (d *Client) getChildIgnoringCase(parent, name string) (*APIObject, error) {
+	children, err := d.cache.GetObjectsByParent(d.contentID(parent))
+	if nil != err {
+		return nil, err
+	}
+
+	var matches []*APIObject
+	for _, child := range children {
+		if strings.EqualFold(child.Name, name) {
+			matches = append(matches, child)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ObjectID < matches[j].ObjectID })
+	if 0 == len(matches) {
+		return nil, fmt.Errorf("Could not find object with name %v in parent %v ignoring case: %w", name, parent, ErrNotFound)
+	}
+	if len(matches) > 1 {
+		Log.Warningf("Found %v objects named %v ignoring case in parent %v, using %v (%v)",
+			len(matches), name, parent, matches[0].ObjectID, matches[0].Name)
+	}
+	return matches[0], nil
+}
+
+// getSharedFolder gets the virtual shared folder if parent is the root of My Drive
+func (d *Client) getSharedFolder(parent string) *APIObject {
+	if "root" != d.rootNodeID {
+		return nil
+	}
+
+	root, err := d.getRootObject()
+	if nil != err || root.ObjectID != parent {
+		return nil
+	}
+
+	return &APIObject{
+		ObjectID:     SharedFolderID,
+		Name:         sharedFolderName,
+		IsDir:        true,
+		LastModified: root.LastModified,
+		Parents:      []string{root.ObjectID},
+	}
+}
+
+// getTrashFolder gets the virtual trash folder if the trash is shown and parent is the mounted root
+func (d *Client) getTrashFolder(parent string) *APIObject {
+	if !ShowTrash {
+		return nil
+	}
+
+	root, err := d.getRootObject()
+	if nil != err || root.ObjectID != parent {
+		return nil
+	}
+
+	return &APIObject{
+		ObjectID:     TrashFolderID,
+		Name:         trashFolderName,
+		IsDir:        true,
+		LastModified: root.LastModified,
+		Parents:      []string{root.ObjectID},
+	}
+}
+
+// GetObjectByPath resolves a slash separated path (relative to the mounted root) to an object,
+// the path can contain the virtual shared, trash and versions folders like the mount
+func (d *Client) GetObjectByPath(path string) (*APIObject, error) {
+	object, err := d.getRootObject()
+	if nil != err {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		if "" == name {
+			continue
+		}
+		if !object.IsDir {
+			return nil, fmt.Errorf("Could not resolve %v, %v is not a directory: %w", path, object.Name, ErrNotFound)
+		}
+
+		child, err := d.GetObjectByParentAndName(object.ObjectID, name)
+		if nil != err {
+			Log.Tracef("%v", err)
+			return nil, fmt.Errorf("Could not find %v of path %v: %w", name, path, ErrNotFound)
+		}
+		object = child
+	}
+
+	return object, nil
+}
+
+// getObjectOrRoot gets an object from the cache or the root object
+func (d *Client) getObjectOrRoot(id string) (*APIObject, error) {
+	if root, err := d.getRootObject(); nil == err && root.ObjectID == id {
+		return root, nil
+	}
+	return d.cache.GetObject(id)
+}
+
+// getRootObject gets the root object, the API is only asked on the first call
+func (d *Client) getRootObject() (*APIObject, error) {
+	d.rootLock.Lock()
+	defer d.rootLock.Unlock()
+
+	if nil == d.rootObject {
+		root, err := d.GetRoot()
+		if nil != err {
+			return nil, err
+		}
+		d.rootObject = root
+	}
+
+	return d.rootObject, nil
 }
 
 // Remove removes file from Google Drive
 func (d *Client) Remove(object *APIObject, parent string) error {
+	if err := d.checkWritable(fmt.Sprintf("remove object %v (%v)", object.ObjectID, object.Name), object.ObjectID, parent); nil != err {
+		return err
+	}
+	if object.Photos {
+		return fmt.Errorf("Could not remove object %v (%v), Google Photos items are read only: %w", object.ObjectID, object.Name, ErrReadOnly)
+	}
+
 	client, err := d.getClient()
 	if nil != err {
 		Log.Debugf("%v", err)
@@ -293,13 +1005,23 @@ func (d *Client) Remove(object *APIObject, parent string) error {
 
 	go func() {
 		if object.CanTrash {
-			if _, err := client.Files.Update(object.ObjectID, &gdrive.File{Trashed: true}).SupportsAllDrives(true).Do(); nil != err {
-				Log.Debugf("%v", err)
-				Log.Warningf("Could not delete object %v (%v) from API", object.ObjectID, object.Name)
+			var err error
+			// removing an object from the trash deletes it permanently
+			if d.deletePermanently || object.Trashed {
+				err = d.Delete(object.ObjectID)
+			} else {
+				err = d.Trash(object.ObjectID)
+			}
+			if nil != err {
+				Log.Warningf("%v", err)
 				d.cache.UpdateObject(object)
 			}
 		} else {
-			if _, err := client.Files.Update(object.ObjectID, nil).RemoveParents(parent).SupportsAllDrives(true).Do(); nil != err {
+			err := doWithRetry(fmt.Sprintf("unsubscribe object %v (%v)", object.ObjectID, object.Name), func() error {
+				_, err := client.Files.Update(object.ObjectID, nil).RemoveParents(parent).Fields("id").SupportsAllDrives(true).Do()
+				return err
+			})
+			if nil != err {
 				Log.Debugf("%v", err)
 				Log.Warningf("Could not unsubscribe object %v (%v) from API", object.ObjectID, object.Name)
 				d.cache.UpdateObject(object)
@@ -310,24 +1032,106 @@ func (d *Client) Remove(object *APIObject, parent string) error {
 	return nil
 }
 
-// Mkdir creates a new directory in Google Drive
-func (d *Client) Mkdir(parent string, Name string) (*APIObject, error) {
+// Trash moves an object to the trash of Google Drive
+func (d *Client) Trash(id string) error {
+	if err := d.checkWritable(fmt.Sprintf("trash object %v", id)); nil != err {
+		return err
+	}
+
 	client, err := d.getClient()
 	if nil != err {
 		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not get Google Drive client")
+		return fmt.Errorf("Could not get Google Drive client")
 	}
 
-	created, err := client.Files.Create(&gdrive.File{Name: Name, Parents: []string{parent}, MimeType: "application/vnd.google-apps.folder"}).SupportsAllDrives(true).Do()
+	err = doWithRetry(fmt.Sprintf("trash object %v", id), func() error {
+		_, err := client.Files.Update(id, &gdrive.File{Trashed: true}).Fields("id").SupportsAllDrives(true).Do()
+		return err
+	})
 	if nil != err {
 		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not create object(%v) from API", Name)
+		return fmt.Errorf("Could not trash object %v in API", id)
 	}
 
-	file, err := client.Files.Get(created.Id).Fields(googleapi.Field(Fields)).SupportsAllDrives(true).Do()
+	return d.removeFromCache(id)
+}
+
+// Delete deletes an object from Google Drive permanently (skipping the trash)
+func (d *Client) Delete(id string) error {
+	if err := d.checkWritable(fmt.Sprintf("delete object %v", id)); nil != err {
+		return err
+	}
+
+	client, err := d.getClient()
 	if nil != err {
 		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not get object fields %v from API", created.Id)
+		return fmt.Errorf("Could not get Google Drive client")
+	}
+
+	err = doWithRetry(fmt.Sprintf("delete object %v", id), func() error {
+		return client.Files.Delete(id).SupportsAllDrives(true).Do()
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not delete object %v from API", id)
+	}
+
+	return d.removeFromCache(id)
+}
+
+// removeFromCache deletes an object and all of its children from the cache,
+// children that have other parents are only detached from the object
+func (d *Client) removeFromCache(id string) error {
+	children, err := d.cache.GetObjectsByParent(id)
+	if nil != err {
+		return err
+	}
+
+	for _, child := range children {
+		if len(child.Parents) > 1 {
+			parents := make([]string, 0, len(child.Parents)-1)
+			for _, parent := range child.Parents {
+				if parent != id {
+					parents = append(parents, parent)
+				}
+			}
+			child.Parents = parents
+			if err := d.cache.UpdateObject(child); nil != err {
+				return err
+			}
+		} else if err := d.removeFromCache(child.ObjectID); nil != err {
+			return err
+		}
+	}
+
+	return d.cache.DeleteObject(id)
+}
+
+// Mkdir creates a new directory in Google Drive
+func (d *Client) Mkdir(parent string, Name string) (*APIObject, error) {
+	if err := d.checkWritable(fmt.Sprintf("create directory %v", Name), parent); nil != err {
+		return nil, err
+	}
+
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	var file *gdrive.File
+	err = doWithRetry(fmt.Sprintf("create folder %v in %v", Name, parent), func() error {
+		var err error
+		file, err = client.Files.
+			Create(&gdrive.File{Name: Name, Parents: []string{parent}, MimeType: folderMimeType}).
+			Fields(googleapi.Field(Fields)).
+			SupportsAllDrives(true).
+			Do()
+		return err
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not create object(%v) from API", Name)
 	}
 
 	Obj, err := d.mapFileToObject(file)
@@ -344,27 +1148,139 @@ func (d *Client) Mkdir(parent string, Name string) (*APIObject, error) {
 	return Obj, nil
 }
 
-// Rename renames file in Google Drive
+// CreateFile uploads a new file to Google Drive (with a resumable upload that is
+// retried chunk by chunk on interruptions)
+func (d *Client) CreateFile(parent string, name string, content io.ReadSeeker) (*APIObject, error) {
+	if err := d.checkWritable(fmt.Sprintf("upload %v", name), parent); nil != err {
+		return nil, err
+	}
+
+	client, err := d.getUploadClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	Log.Infof("Uploading %v", name)
+	return d.uploadFile(fmt.Sprintf("upload %v", name), content, func() (*gdrive.File, error) {
+		return client.Files.
+			Create(&gdrive.File{Name: name, Parents: []string{parent}}).
+			Media(content, googleapi.ChunkSize(uploadChunkSize)).
+			Fields(googleapi.Field(Fields)).
+			SupportsAllDrives(true).
+			Do()
+	})
+}
+
+// UpdateFileContent replaces the content of a file in Google Drive
+func (d *Client) UpdateFileContent(object *APIObject, content io.ReadSeeker) (*APIObject, error) {
+	if err := d.checkWritable(fmt.Sprintf("upload %v", object.Name), object.ObjectID); nil != err {
+		return nil, err
+	}
+
+	client, err := d.getUploadClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	Log.Infof("Uploading %v", object.Name)
+	return d.uploadFile(fmt.Sprintf("upload object %v (%v)", object.ObjectID, object.Name), content, func() (*gdrive.File, error) {
+		return client.Files.
+			Update(object.ObjectID, &gdrive.File{}).
+			Media(content, googleapi.ChunkSize(uploadChunkSize)).
+			Fields(googleapi.Field(Fields)).
+			SupportsAllDrives(true).
+			Do()
+	})
+}
+
+// uploadFile sends the resumable upload and stores the uploaded file in the cache, the chunks
+// are retried by the upload itself and a failed upload is started again from the beginning of
+// the content like the other API calls (nothing is created until the last chunk has been sent)
+func (d *Client) uploadFile(description string, content io.ReadSeeker, upload func() (*gdrive.File, error)) (*APIObject, error) {
+	var file *gdrive.File
+	err := doWithRetry(description, func() error {
+		if _, err := content.Seek(0, io.SeekStart); nil != err {
+			return err
+		}
+		var err error
+		file, err = upload()
+		return err
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not %v to API", description)
+	}
+
+	object, err := d.mapFileToObject(file)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not map file to object %v (%v)", file.Id, file.Name)
+	}
+
+	if err := d.cache.UpdateObject(object); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not create object %v (%v) in cache", object.ObjectID, object.Name)
+	}
+
+	return object, nil
+}
+
+// Rename renames and / or moves file in Google Drive
 func (d *Client) Rename(object *APIObject, OldParent string, NewParent string, NewName string) error {
+	if err := d.checkWritable(fmt.Sprintf("rename object %v (%v)", object.ObjectID, object.Name), object.ObjectID, OldParent, NewParent); nil != err {
+		return err
+	}
+	if object.Photos {
+		return fmt.Errorf("Could not rename object %v (%v), Google Photos items are read only: %w", object.ObjectID, object.Name, ErrReadOnly)
+	}
+
 	client, err := d.getClient()
 	if nil != err {
 		Log.Debugf("%v", err)
 		return fmt.Errorf("Could not get Google Drive client")
 	}
 
-	if _, err := client.Files.Update(object.ObjectID, &gdrive.File{Name: NewName}).RemoveParents(OldParent).AddParents(NewParent).SupportsAllDrives(true).Do(); nil != err {
+	name := NewName
+	if ExportExtensions && "" != object.ExportMimeType {
+		name = exportDriveName(name, object.ExportMimeType)
+	}
+	call := client.Files.Update(object.ObjectID, &gdrive.File{Name: name}).Fields("id").SupportsAllDrives(true)
+	if OldParent != NewParent {
+		parent, err := d.getObjectOrRoot(NewParent)
+		if nil != err {
+			return err
+		}
+		if parent.DriveID != object.DriveID {
+			return fmt.Errorf("Could not move object %v (%v) to %v: %w", object.ObjectID, object.Name, parent.Name, ErrCrossDriveMove)
+		}
+
+		call = call.AddParents(NewParent)
+		if SharedFolderID != OldParent {
+			call = call.RemoveParents(OldParent)
+		}
+	}
+
+	err = doWithRetry(fmt.Sprintf("rename object %v (%v)", object.ObjectID, object.Name), func() error {
+		_, err := call.Do()
+		return err
+	})
+	if nil != err {
 		Log.Debugf("%v", err)
 		return fmt.Errorf("Could not rename object %v (%v) from API", object.ObjectID, object.Name)
 	}
 
 	object.Name = NewName
-	for i, p := range object.Parents {
-		if p == OldParent {
-			object.Parents = append(object.Parents[:i], object.Parents[i+1:]...)
-			break
+	if OldParent != NewParent {
+		for i, p := range object.Parents {
+			if p == OldParent {
+				object.Parents = append(object.Parents[:i], object.Parents[i+1:]...)
+				break
+			}
 		}
+		object.Parents = append(object.Parents, NewParent)
 	}
-	object.Parents = append(object.Parents, NewParent)
 
 	if err := d.cache.UpdateObject(object); nil != err {
 		Log.Debugf("%v", err)
@@ -374,30 +1290,131 @@ func (d *Client) Rename(object *APIObject, OldParent string, NewParent string, N
 	return nil
 }
 
+// fileTimeLayouts are the layouts of the timestamps returned by the API, RFC 3339 with or
+// without fractional seconds and (rarely) without time zone
+var fileTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"}
+
+// ValidateMTimeSource checks that the timestamp can be used as modification time
+func ValidateMTimeSource(source string) error {
+	switch source {
+	case MTimeModified, MTimeCreated, MTimeViewed, MTimeNewest:
+		return nil
+	}
+	return fmt.Errorf("Invalid mtime source %v (modified, created, viewed or newest)", source)
+}
+
+// parseModifiedTime gets the time the content of the file was last modified (the creation time
+// when it is missing or invalid), the cached chunks and export sizes depend on it
+func parseModifiedTime(file *gdrive.File) time.Time {
+	return parseFileTimes(file, []string{file.ModifiedTime, file.CreatedTime}, false)
+}
+
+// parseMTime gets the timestamp of the file selected by MTimeSource (the newest of all
+// timestamps for MTimeNewest) that is shown as modification time
+func parseMTime(file *gdrive.File) time.Time {
+	values := []string{file.ModifiedTime, file.CreatedTime}
+	switch MTimeSource {
+	case MTimeCreated:
+		values = []string{file.CreatedTime, file.ModifiedTime}
+	case MTimeViewed, MTimeNewest:
+		values = []string{file.ViewedByMeTime, file.ModifiedTime, file.CreatedTime}
+	}
+	return parseFileTimes(file, values, MTimeNewest == MTimeSource)
+}
+
+// parseFileTimes gets the first valid timestamp of the values (or the newest one), the Unix epoch
+// is used as last resort (the current time would change the modification time with every fetch)
+func parseFileTimes(file *gdrive.File, values []string, useNewest bool) time.Time {
+	var newest time.Time
+	for _, value := range values {
+		parsed, ok := parseFileTime(file, value)
+		if !ok {
+			continue
+		}
+		if !useNewest {
+			return parsed
+		}
+		if parsed.After(newest) {
+			newest = parsed
+		}
+	}
+	if !newest.IsZero() {
+		return newest
+	}
+	return time.Unix(0, 0).UTC()
+}
+
+// parseFileTime parses a timestamp of the file, false is returned when it is missing or invalid
+func parseFileTime(file *gdrive.File, value string) (time.Time, bool) {
+	if "" == value {
+		return time.Time{}, false
+	}
+	for _, layout := range fileTimeLayouts {
+		if parsed, err := time.Parse(layout, value); nil == err {
+			return parsed, true
+		}
+	}
+	Log.Debugf("Could not parse time %v of object %v (%v)", value, file.Id, file.Name)
+	return time.Time{}, false
+}
+
+// mapVideoMetadata maps the video metadata of a file, nil is returned when the file
+// has no metadata (yet)
+func mapVideoMetadata(metadata *gdrive.FileVideoMediaMetadata) *VideoMetadata {
+	if nil == metadata || (0 == metadata.Width && 0 == metadata.Height && 0 == metadata.DurationMillis) {
+		return nil
+	}
+	return &VideoMetadata{
+		Width:    metadata.Width,
+		Height:   metadata.Height,
+		Duration: time.Duration(metadata.DurationMillis) * time.Millisecond,
+	}
+}
+
 // mapFileToObject maps a Google Drive file to APIObject
 func (d *Client) mapFileToObject(file *gdrive.File) (*APIObject, error) {
 	Log.Tracef("Converting Google Drive file: %v", file)
 
-	lastModified, err := time.Parse(time.RFC3339, file.ModifiedTime)
-	if nil != err {
-		Log.Debugf("%v", err)
-		Log.Warningf("Could not parse last modified date for object %v (%v)", file.Id, file.Name)
-		lastModified = time.Now()
-	}
+	lastModified := parseModifiedTime(file)
 
 	var parents []string
 	for _, parent := range file.Parents {
 		parents = append(parents, parent)
 	}
 
+	exportMimeType, _ := getExportMimeType(file.MimeType)
+	downloadURL := getDownloadURL(file.Id, exportMimeType)
+	name := file.Name
+	if ExportExtensions && "" != exportMimeType {
+		name = exportName(name, exportMimeType)
+	}
+
+	isDir := file.MimeType == folderMimeType
+	photos := isPhotosOnly(file)
+	shortcutTargetID := ""
+	if shortcutMimeType == file.MimeType && nil != file.ShortcutDetails {
+		shortcutTargetID = file.ShortcutDetails.TargetId
+		isDir = file.ShortcutDetails.TargetMimeType == folderMimeType
+	}
+
 	return &APIObject{
-		ObjectID:     file.Id,
-		Name:         file.Name,
-		IsDir:        file.MimeType == "application/vnd.google-apps.folder",
-		LastModified: lastModified,
-		Size:         uint64(file.Size),
-		DownloadURL:  fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%v?alt=media", file.Id),
-		Parents:      parents,
-		CanTrash:     file.Capabilities.CanTrash,
+		CachedAt:         time.Now(),
+		ObjectID:         file.Id,
+		Name:             name,
+		IsDir:            isDir,
+		LastModified:     lastModified,
+		MTime:            parseMTime(file),
+		Size:             uint64(file.Size),
+		DownloadURL:      downloadURL,
+		Parents:          parents,
+		CanTrash:         nil != file.Capabilities && file.Capabilities.CanTrash && !photos,
+		DriveID:          file.DriveId,
+		MimeType:         file.MimeType,
+		MD5:              file.Md5Checksum,
+		ExportMimeType:   exportMimeType,
+		ShortcutTargetID: shortcutTargetID,
+		Trashed:          file.ExplicitlyTrashed,
+		Video:            mapVideoMetadata(file.VideoMediaMetadata),
+		Photos:           photos,
 	}, nil
 }
@@ -0,0 +1,74 @@
+package drive
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// renameDuplicates gives objects that have the same name as another object in the folder a
+// unique name with their id (e.g. movie (id).mkv), the object with the lowest id keeps the name
+func renameDuplicates(objects []*APIObject) []*APIObject {
+	byName := make(map[string][]*APIObject, len(objects))
+	for _, object := range objects {
+		byName[object.Name] = append(byName[object.Name], object)
+	}
+
+	for _, duplicates := range byName {
+		if len(duplicates) < 2 {
+			continue
+		}
+		sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].ObjectID < duplicates[j].ObjectID })
+		for _, object := range duplicates[1:] {
+			object.Name = duplicateName(object)
+		}
+	}
+	return objects
+}
+
+// duplicateName gets the unique name of an object with the id before the file extension
+func duplicateName(object *APIObject) string {
+	extension := ""
+	if !object.IsDir {
+		extension = path.Ext(object.Name)
+	}
+	return fmt.Sprintf("%v (%v)%v", strings.TrimSuffix(object.Name, extension), object.ObjectID, extension)
+}
+
+// getDuplicateChild gets a child by the unique name of an object with a duplicate name, the
+// name is only found if the object really has it in the listing of the parent
+func (d *Client) getDuplicateChild(parent, name string) (*APIObject, error) {
+	start := strings.LastIndex(name, " (")
+	end := strings.LastIndex(name, ")")
+	if start < 0 || end < start+2 {
+		return nil, fmt.Errorf("Could not find object with name %v in parent %v: %w", name, parent, ErrNotFound)
+	}
+
+	object, err := d.cache.GetObject(name[start+2 : end])
+	if nil != err {
+		return nil, fmt.Errorf("Could not find object with name %v in parent %v: %w", name, parent, ErrNotFound)
+	}
+	contentID := d.contentID(parent)
+	for _, p := range indexParents(object) {
+		if p == contentID {
+			return d.getListedChild(parent, name)
+		}
+	}
+	return nil, fmt.Errorf("Could not find object with name %v in parent %v: %w", name, parent, ErrNotFound)
+}
+
+// getListedChild gets the child with the name it has in the listing of the parent (excluded
+// objects are removed before duplicates are renamed, so they never force a rename)
+func (d *Client) getListedChild(parent, name string) (*APIObject, error) {
+	children, err := d.cache.GetObjectsByParent(d.contentID(parent))
+	if nil != err {
+		return nil, err
+	}
+	for _, child := range renameDuplicates(filterObjects(d.resolveShortcuts(children))) {
+		if child.Name == name {
+			return child, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find object with name %v in parent %v: %w", name, parent, ErrNotFound)
+}
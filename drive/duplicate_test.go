@@ -0,0 +1,76 @@
+package drive
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDuplicateNames(t *testing.T) {
+	sqliteCache, cleanupSQLite := newTestSQLiteCache(t)
+	defer cleanupSQLite()
+	boltCache, cleanupBolt := newTestCache(t)
+	defer cleanupBolt()
+
+	defer func() { Excludes = nil }()
+
+	for _, cache := range []Cache{sqliteCache, boltCache} {
+		cache.BatchUpdateObjects([]*APIObject{
+			{ObjectID: "b", Name: "movie.mkv", Parents: []string{"root-id"}},
+			{ObjectID: "a", Name: "movie.mkv", Parents: []string{"root-id"}},
+			{ObjectID: "c", Name: "Season 1", IsDir: true, Parents: []string{"root-id"}},
+			{ObjectID: "d", Name: "Season 1", IsDir: true, Parents: []string{"root-id"}},
+		})
+		client := &Client{cache: cache, rootNodeID: "root-id", rootObject: &APIObject{ObjectID: "root-id", IsDir: true}}
+
+		children, err := client.GetObjectsByParent("root-id")
+		if nil != err {
+			t.Fatal(err)
+		}
+		names := make(map[string]string, len(children))
+		for _, child := range children {
+			names[child.Name] = child.ObjectID
+		}
+		if 4 != len(names) || "a" != names["movie.mkv"] || "b" != names["movie (b).mkv"] || "d" != names["Season 1 (d)"] {
+			t.Fatalf("Expected every duplicate to have a unique name got %v", names)
+		}
+
+		for name, id := range names {
+			object, err := client.GetObjectByPath("/" + name)
+			if nil != err || id != object.ObjectID {
+				t.Fatalf("Expected %v for %v got %v (%v)", id, name, object, err)
+			}
+		}
+		for _, name := range []string{"movie (c).mkv", "movie (missing).mkv", "movie (b).avi"} {
+			if _, err := client.GetObjectByParentAndName("root-id", name); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Expected %v not to be found got %v", name, err)
+			}
+		}
+
+		if _, err := client.GetObjectByParentAndName("root-id", "movie (a).mkv"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected the object that keeps the name not to be found by its unique name got %v", err)
+		}
+
+		Excludes = []string{"a"}
+		children, _ = client.GetObjectsByParent("root-id")
+		for _, child := range children {
+			if "b" == child.ObjectID && "movie.mkv" != child.Name {
+				t.Fatalf("Expected an excluded namesake not to force a rename got %v", child.Name)
+			}
+		}
+		if object, err := client.GetObjectByParentAndName("root-id", "movie.mkv"); nil != err || "b" != object.ObjectID {
+			t.Fatalf("Expected the duplicate of an excluded object to keep the name got %v (%v)", object, err)
+		}
+		if _, err := client.GetObjectByParentAndName("root-id", "movie (b).mkv"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected no unique name without a visible namesake got %v", err)
+		}
+		Excludes = nil
+
+		cache.DeleteObject("a")
+		if object, err := client.GetObjectByParentAndName("root-id", "movie.mkv"); nil != err || "b" != object.ObjectID {
+			t.Fatalf("Expected the remaining duplicate got %v (%v)", object, err)
+		}
+		if _, err := client.GetObjectByParentAndName("root-id", "movie (b).mkv"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected no unique name without a namesake got %v", err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package drive
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/dweidenfeld/plexdrive/metrics"
+)
+
+// googleAppsPrefix is the mime type prefix of all native Google Docs formats
+const googleAppsPrefix = "application/vnd.google-apps."
+
+// ExportFormats maps the native Google Docs formats (without the mime type prefix)
+// to the mime type they should be exported as
+var ExportFormats = map[string]string{
+	"document":     "application/pdf",
+	"spreadsheet":  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"presentation": "application/pdf",
+	"drawing":      "application/pdf",
+}
+
+// ExportExtensions appends the extension of the export format to the names of native Google Docs files
+var ExportExtensions bool
+
+// exportExtensions are the file extensions of the export formats of Google Docs
+var exportExtensions = map[string]string{
+	"application/pdf": ".pdf",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/vnd.oasis.opendocument.spreadsheet":                            ".ods",
+	"application/vnd.oasis.opendocument.presentation":                           ".odp",
+	"application/rtf":           ".rtf",
+	"application/epub+zip":      ".epub",
+	"application/zip":           ".zip",
+	"text/plain":                ".txt",
+	"text/html":                 ".html",
+	"text/csv":                  ".csv",
+	"text/tab-separated-values": ".tsv",
+	"image/png":                 ".png",
+	"image/jpeg":                ".jpg",
+	"image/svg+xml":             ".svg",
+}
+
+// exportName gets the name of an exported file with the extension of the export format,
+// names that already end with the extension are kept
+func exportName(name, exportMimeType string) string {
+	extension, exists := exportExtensions[exportMimeType]
+	if !exists || strings.EqualFold(path.Ext(name), extension) {
+		return name
+	}
+	return name + extension
+}
+
+// exportDriveName removes the extension of the export format that exportName appends, so that
+// renamed files don't get the extension twice
+func exportDriveName(name, exportMimeType string) string {
+	extension, exists := exportExtensions[exportMimeType]
+	if !exists || "" == strings.TrimSuffix(name, extension) {
+		return name
+	}
+	return strings.TrimSuffix(name, extension)
+}
+
+// getExportMimeType gets the mime type a native Google Docs file should be exported as
+func getExportMimeType(mimeType string) (string, bool) {
+	if !strings.HasPrefix(mimeType, googleAppsPrefix) {
+		return "", false
+	}
+	exportMimeType, exists := ExportFormats[strings.TrimPrefix(mimeType, googleAppsPrefix)]
+	return exportMimeType, exists
+}
+
+// getDownloadURL gets the URL to read the content of a file, native Google Docs files
+// are exported (the export mime type is empty for all other files)
+func getDownloadURL(id, exportMimeType string) string {
+	if "" != exportMimeType {
+		return getExportURL(id, exportMimeType)
+	}
+	return fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%v?alt=media", id)
+}
+
+// getExportURL gets the URL to export a native Google Docs file
+func getExportURL(id, exportMimeType string) string {
+	return fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%v/export?mimeType=%v", id, url.QueryEscape(exportMimeType))
+}
+
+// GetExportSize determines the size of an exported object by streaming the whole export,
+// the size is stored in the cache and reused until the object is modified
+func (d *Client) GetExportSize(object *APIObject) (uint64, error) {
+	cached, err := d.cache.GetObject(exportSizeID(object))
+	if nil != err || !sameExport(cached, object) {
+		cached = nil
+	}
+	if nil != cached && (cached.ExportSizeKnown || cached.Size > 0) {
+		Log.Tracef("Using cached export size %v of object %v (%v)", cached.Size, object.ObjectID, object.Name)
+		return cached.Size, nil
+	}
+
+	if d.IsDegraded() {
+		return 0, fmt.Errorf("Could not get export size of object %v (%v): %w", object.ObjectID, object.Name, ErrDegraded)
+	}
+
+	Log.Debugf("Getting export size for object %v (%v)", object.ObjectID, object.Name)
+
+	metrics.APIRequests.WithLabelValues("download").Inc()
+	res, err := d.GetNativeClient().Get(object.GetDownloadURL())
+	if nil != err {
+		Log.Debugf("%v", err)
+		return 0, fmt.Errorf("Could not export object %v (%v) from API", object.ObjectID, object.Name)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return 0, fmt.Errorf("Wrong status code %v for export of object %v (%v)", res.StatusCode, object.ObjectID, object.Name)
+	}
+
+	size, err := io.Copy(ioutil.Discard, res.Body)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return 0, fmt.Errorf("Could not read export of object %v (%v)", object.ObjectID, object.Name)
+	}
+
+	if nil != cached {
+		cached.Size = uint64(size)
+		cached.ExportSizeKnown = true
+		if err := d.cache.UpdateObject(cached); nil != err {
+			Log.Warningf("%v", err)
+		}
+	}
+
+	return uint64(size), nil
+}
+
+// keepExportSize copies the cached export size to an updated object whose content has not
+// been modified (native Google Docs files are listed without a size)
+func (d *Client) keepExportSize(object *APIObject) {
+	if "" == object.ExportMimeType || object.ExportSizeKnown || 0 != object.Size {
+		return
+	}
+	if cached, err := d.cache.GetObject(object.ObjectID); nil == err && sameExport(cached, object) {
+		object.Size = cached.Size
+		object.ExportSizeKnown = cached.ExportSizeKnown
+	}
+}
+
+// exportSizeID gets the id of the object the export size is stored on (the target of a shortcut)
+func exportSizeID(object *APIObject) string {
+	if "" != object.ShortcutTargetID {
+		return object.ShortcutTargetID
+	}
+	return object.ObjectID
+}
+
+// sameExport checks if both objects are exported from the same content in the same format
+func sameExport(cached, object *APIObject) bool {
+	return cached.LastModified.Equal(object.LastModified) && cached.ExportMimeType == object.ExportMimeType
+}
@@ -0,0 +1,109 @@
+package drive
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	gdrive "google.golang.org/api/drive/v3"
+)
+
+func TestGetExportSizeIsCached(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	probes := 0
+	client := newTestClient(cache, func(r *http.Request) (int, string) {
+		probes++
+		return 200, string(make([]byte, 42))
+	})
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	doc := &APIObject{ObjectID: "doc", Name: "doc.pdf", LastModified: modified, ExportMimeType: "application/pdf"}
+	cache.UpdateObject(doc)
+
+	for i := 0; i < 2; i++ {
+		object, _ := cache.GetObject("doc")
+		if size, err := client.GetExportSize(object); nil != err || 42 != size {
+			t.Fatalf("Expected an export size of 42 got %v (%v)", size, err)
+		}
+	}
+	if 1 != probes {
+		t.Fatalf("Expected one size probe got %v", probes)
+	}
+
+	// a change without a new modification time keeps the size
+	renamed := *doc
+	renamed.Name = "renamed.pdf"
+	client.keepExportSize(&renamed)
+	if 42 != renamed.Size {
+		t.Fatalf("Expected the cached export size to be kept got %v", renamed.Size)
+	}
+
+	// a modified document is probed again
+	modifiedDoc := *doc
+	modifiedDoc.LastModified = modified.Add(time.Hour)
+	client.keepExportSize(&modifiedDoc)
+	if 0 != modifiedDoc.Size {
+		t.Fatalf("Expected no export size for a modified document got %v", modifiedDoc.Size)
+	}
+	cache.UpdateObject(&modifiedDoc)
+	client.GetExportSize(&modifiedDoc)
+	if 2 != probes {
+		t.Fatalf("Expected a second size probe for the modified document got %v", probes)
+	}
+}
+
+func TestEmptyExportSizeIsCached(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	probes := 0
+	client := newTestClient(cache, func(r *http.Request) (int, string) {
+		probes++
+		return 200, ""
+	})
+	cache.UpdateObject(&APIObject{ObjectID: "doc", Name: "empty.pdf", ExportMimeType: "application/pdf"})
+
+	for i := 0; i < 2; i++ {
+		object, _ := cache.GetObject("doc")
+		if size, err := client.GetExportSize(object); nil != err || 0 != size {
+			t.Fatalf("Expected an export size of 0 got %v (%v)", size, err)
+		}
+	}
+	if 1 != probes {
+		t.Fatalf("Expected one size probe for an empty export got %v", probes)
+	}
+}
+
+func TestExportExtensions(t *testing.T) {
+	ExportExtensions = true
+	presentation := ExportFormats["presentation"]
+	ExportFormats["presentation"] = "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	defer func() {
+		ExportExtensions = false
+		ExportFormats["presentation"] = presentation
+	}()
+
+	client := &Client{}
+	for _, test := range []struct {
+		name, mimeType, expected string
+	}{
+		{"Report", "application/vnd.google-apps.document", "Report.pdf"},
+		{"Report.PDF", "application/vnd.google-apps.document", "Report.PDF"},
+		{"Budget 2020", "application/vnd.google-apps.spreadsheet", "Budget 2020.xlsx"},
+		{"Talk", "application/vnd.google-apps.presentation", "Talk.pptx"},
+		{"movie.mkv", "video/x-matroska", "movie.mkv"},
+	} {
+		object, err := client.mapFileToObject(&gdrive.File{Id: "1", Name: test.name, MimeType: test.mimeType, Capabilities: &gdrive.FileCapabilities{}})
+		if nil != err {
+			t.Fatal(err)
+		}
+		if test.expected != object.Name {
+			t.Fatalf("Expected %v for %v got %v", test.expected, test.name, object.Name)
+		}
+	}
+
+	if "Report" != exportDriveName("Report.pdf", "application/pdf") || ".pdf" != exportDriveName(".pdf", "application/pdf") {
+		t.Fatalf("Expected the export extension to be removed for the Google Drive name")
+	}
+}
@@ -0,0 +1,68 @@
+package drive
+
+import (
+	"path/filepath"
+)
+
+// Excludes are glob patterns (matched against the object name, not its path) or object ids of objects
+// that are hidden in the mount, excluded folders hide their whole content
+var Excludes []string
+
+// MimeTypeAllowlist are the mime types (e.g. video/*) of the only files that are shown, all files are shown if empty
+var MimeTypeAllowlist []string
+
+// MimeTypeDenylist are the mime types (e.g. application/zip) of files that are hidden
+var MimeTypeDenylist []string
+
+// MinFileSize is the size in bytes files must have at least to be shown, all files are shown if 0
+var MinFileSize uint64
+
+// isExcluded checks if the object matches one of the exclude patterns or is filtered by its
+// mime type or size (folders are never filtered by mime type or size, neither are shortcuts
+// and exported Google Docs by size because their size is not known)
+func isExcluded(object *APIObject) bool {
+	for _, pattern := range Excludes {
+		if pattern == object.ObjectID {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, object.Name); matched {
+			return true
+		}
+	}
+
+	if object.IsDir {
+		return false
+	}
+	if object.Size < MinFileSize && "" == object.ShortcutTargetID && "" == object.ExportMimeType {
+		return true
+	}
+	if len(MimeTypeAllowlist) > 0 && !matchesMimeType(MimeTypeAllowlist, object.MimeType) {
+		return true
+	}
+	return matchesMimeType(MimeTypeDenylist, object.MimeType)
+}
+
+// matchesMimeType checks if the mime type matches one of the patterns
+func matchesMimeType(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, mimeType); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// filterObjects removes all excluded objects
+func filterObjects(objects []*APIObject) []*APIObject {
+	if 0 == len(Excludes) && 0 == len(MimeTypeAllowlist) && 0 == len(MimeTypeDenylist) && 0 == MinFileSize {
+		return objects
+	}
+
+	filtered := make([]*APIObject, 0, len(objects))
+	for _, object := range objects {
+		if !isExcluded(object) {
+			filtered = append(filtered, object)
+		}
+	}
+	return filtered
+}
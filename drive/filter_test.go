@@ -0,0 +1,154 @@
+package drive
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestExcludes(t *testing.T) {
+	Excludes = []string{"Backups", "*.iso", "id-1"}
+	defer func() { Excludes = nil }()
+
+	objects := filterObjects([]*APIObject{
+		{ObjectID: "a", Name: "Backups", IsDir: true},
+		{ObjectID: "b", Name: "disk.iso"},
+		{ObjectID: "id-1", Name: "Photos", IsDir: true},
+		{ObjectID: "c", Name: "movie.mkv"},
+	})
+	if 1 != len(objects) || "c" != objects[0].ObjectID {
+		t.Fatalf("Expected only object c got %v", objects)
+	}
+}
+
+func TestMimeTypeFilter(t *testing.T) {
+	MimeTypeAllowlist = []string{"video/*", "text/plain"}
+	MimeTypeDenylist = []string{"video/x-msvideo"}
+	defer func() {
+		MimeTypeAllowlist = nil
+		MimeTypeDenylist = nil
+	}()
+
+	objects := filterObjects([]*APIObject{
+		{ObjectID: "a", Name: "Movies", IsDir: true, MimeType: "application/vnd.google-apps.folder"},
+		{ObjectID: "b", Name: "movie.mkv", MimeType: "video/x-matroska"},
+		{ObjectID: "c", Name: "movie.srt", MimeType: "text/plain"},
+		{ObjectID: "d", Name: "movie.avi", MimeType: "video/x-msvideo"},
+		{ObjectID: "e", Name: "movie.zip", MimeType: "application/zip"},
+	})
+	if 3 != len(objects) || "a" != objects[0].ObjectID || "b" != objects[1].ObjectID || "c" != objects[2].ObjectID {
+		t.Fatalf("Expected objects a, b and c got %v", objects)
+	}
+}
+
+func TestMinFileSize(t *testing.T) {
+	MinFileSize = 1024
+	defer func() { MinFileSize = 0 }()
+
+	objects := filterObjects([]*APIObject{
+		{ObjectID: "a", Name: "Movies", IsDir: true},
+		{ObjectID: "b", Name: "movie.mkv", Size: 4096},
+		{ObjectID: "c", Name: "exact.mkv", Size: 1024},
+		{ObjectID: "d", Name: "thumb.jpg", Size: 1023},
+		{ObjectID: "e", Name: "document", ExportMimeType: "application/pdf"},
+		{ObjectID: "f", Name: "shortcut.mkv", ShortcutTargetID: "b"},
+	})
+	if 5 != len(objects) {
+		t.Fatalf("Expected all objects except d got %v", objects)
+	}
+	for _, object := range objects {
+		if "d" == object.ObjectID {
+			t.Fatalf("Expected the small file to be hidden got %v", objects)
+		}
+	}
+}
+
+func TestExcludedObjectsShowUpAgain(t *testing.T) {
+	Excludes = []string{"*.iso"}
+	defer func() { Excludes = nil }()
+
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+	client := newTestClient(cache, func(r *http.Request) (int, string) {
+		return 200, `{"newStartPageToken": "2", "changes": [
+			{"changeType": "file", "fileId": "a", "file": {"id": "a", "name": "disc.iso", "parents": ["root-id"], "capabilities": {}}}
+		]}`
+	})
+
+	objects, deletedIDs, _, err := client.GetChanges("1")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(objects) || 0 != len(deletedIDs) {
+		t.Fatalf("Expected the excluded object to be stored got %v / %v", objects, deletedIDs)
+	}
+	cache.BatchUpdateObjects(objects)
+
+	if children, _ := client.GetObjectsByParent("root-id"); 0 != len(children) {
+		t.Fatalf("Expected the excluded object to be hidden got %v", children)
+	}
+	Excludes = nil
+	if children, _ := client.GetObjectsByParent("root-id"); 1 != len(children) {
+		t.Fatalf("Expected the object to show up again without the exclude got %v", children)
+	}
+}
+
+func TestMimeTypeFilteredObjectsShowUpAgain(t *testing.T) {
+	MimeTypeAllowlist = []string{"video/*"}
+	defer func() { MimeTypeAllowlist = nil }()
+
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+	client := newTestClient(cache, func(r *http.Request) (int, string) {
+		return 200, `{"files": [
+			{"id": "a", "name": "movie.mkv", "mimeType": "video/x-matroska", "parents": ["root-id"], "capabilities": {}},
+			{"id": "b", "name": "movie.srt", "mimeType": "text/plain", "parents": ["root-id"], "capabilities": {}}
+		]}`
+	})
+
+	objects, err := client.listFiles("trashed = false", "files")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(objects) {
+		t.Fatalf("Expected the filtered object to be stored got %v", objects)
+	}
+	cache.BatchUpdateObjects(objects)
+
+	if children, _ := client.GetObjectsByParent("root-id"); 1 != len(children) || "a" != children[0].ObjectID {
+		t.Fatalf("Expected only object a got %v", children)
+	}
+	MimeTypeAllowlist = append(MimeTypeAllowlist, "text/plain")
+	if children, _ := client.GetObjectsByParent("root-id"); 2 != len(children) {
+		t.Fatalf("Expected object b to show up again with the loosened filter got %v", children)
+	}
+}
+
+func TestSmallFilesShowUpAgain(t *testing.T) {
+	MinFileSize = 1000
+	defer func() { MinFileSize = 0 }()
+
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+	client := newTestClient(cache, func(r *http.Request) (int, string) {
+		return 200, `{"newStartPageToken": "2", "changes": [
+			{"changeType": "file", "fileId": "a", "file": {"id": "a", "name": "thumb.jpg", "size": "10", "parents": ["root-id"], "capabilities": {}}}
+		]}`
+	})
+
+	objects, deletedIDs, _, err := client.GetChanges("1")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(objects) || 0 != len(deletedIDs) {
+		t.Fatalf("Expected the small file to be stored got %v / %v", objects, deletedIDs)
+	}
+	cache.BatchUpdateObjects(objects)
+
+	if children, _ := client.GetObjectsByParent("root-id"); 0 != len(children) {
+		t.Fatalf("Expected the small file to be hidden got %v", children)
+	}
+	MinFileSize = 10
+	if children, _ := client.GetObjectsByParent("root-id"); 1 != len(children) {
+		t.Fatalf("Expected the small file to show up again with a lower size got %v", children)
+	}
+}
@@ -0,0 +1,107 @@
+package drive
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/dweidenfeld/plexdrive/metrics"
+)
+
+// healthCacheDuration is the time the result of a health check is reused
+const healthCacheDuration = 30 * time.Second
+
+// Health is the result of a health check
+type Health struct {
+	Healthy     bool           `json:"healthy"`
+	Error       string         `json:"error,omitempty"`
+	Degraded    bool           `json:"degraded"`
+	Revoked     bool           `json:"authorization_revoked"`
+	Account     *AccountStatus `json:"account,omitempty"`
+	LastRefresh time.Time      `json:"last_refresh"`
+	CheckedAt   time.Time      `json:"checked_at"`
+}
+
+// CheckHealth gets the account status to check that the token is accepted by Google Drive
+// and checks that the cache is reachable (the result is reused for a short time to save
+// API quota), Degraded is set while only the cache is served because the change checks keep failing
+func (d *Client) CheckHealth() Health {
+	d.healthLock.Lock()
+	defer d.healthLock.Unlock()
+
+	if time.Since(d.health.CheckedAt) < healthCacheDuration {
+		d.health.LastRefresh = d.getLastRefresh()
+		d.health.Degraded = d.IsDegraded()
+		return d.health
+	}
+
+	health := Health{
+		Healthy:   true,
+		CheckedAt: time.Now(),
+	}
+	account, err := d.AccountStatus()
+	health.Account = account
+	if nil != err && account.Revoked {
+		Log.Debugf("%v", err)
+		health.Healthy = false
+		health.Revoked = true
+		health.Error = "The authorization has been revoked, restart plexdrive to authorize again"
+	} else if nil != err {
+		Log.Debugf("%v", err)
+		health.Healthy = false
+		health.Error = "Could not reach Google Drive"
+	} else if _, err := d.cache.GetStartPageToken(); nil != err {
+		Log.Debugf("%v", err)
+		health.Healthy = false
+		health.Error = "Cache is not reachable or not built yet"
+	}
+	health.LastRefresh = d.getLastRefresh()
+	health.Degraded = d.IsDegraded()
+
+	d.health = health
+	return health
+}
+
+// CacheStats gets the statistics of the metadata cache and updates the cache metrics, it reads
+// the whole cache so it is only called for metrics scrapes and the stats control command
+func (d *Client) CacheStats() (*CacheStats, error) {
+	stats, err := d.cache.Stats()
+	if nil != err {
+		return nil, err
+	}
+	metrics.CacheObjects.Set(float64(stats.Objects))
+	metrics.CacheBytes.Set(float64(stats.Bytes))
+	return stats, nil
+}
+
+// getLastRefresh gets the time of the last successful change check
+func (d *Client) getLastRefresh() time.Time {
+	d.changesLock.Lock()
+	defer d.changesLock.Unlock()
+	return d.lastRefresh
+}
+
+// ServeHealth starts the HTTP listener for the /health endpoint in the background,
+// it responds with 200 when plexdrive is healthy and with 503 otherwise
+func (d *Client) ServeHealth(address string) {
+	Log.Infof("Serving health checks on %v/health", address)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		health := d.CheckHealth()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+
+	go func() {
+		if err := http.ListenAndServe(address, mux); nil != err {
+			Log.Debugf("%v", err)
+			Log.Errorf("Could not serve health checks on %v", address)
+		}
+	}()
+}
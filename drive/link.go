@@ -0,0 +1,46 @@
+package drive
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// GetTemporaryLink gets a direct download link for the file (a path starting with / or an
+// object id) that is valid for at least the ttl, native Google Docs files get an export link.
+// The link contains a separate access token with the same permissions as plexdrive (until it
+// expires after at most one hour), so it must be treated like a password.
+func (d *Client) GetTemporaryLink(target string, ttl time.Duration) (string, error) {
+	object, err := d.ResolveTarget(target)
+	if nil != err {
+		return "", err
+	}
+	if object.IsDir {
+		return "", fmt.Errorf("Could not create a link for folder %v (%v)", object.ObjectID, object.Name)
+	}
+	if nil == d.newTokenSource {
+		return "", fmt.Errorf("Could not create a link for %v, the client is not authorized", target)
+	}
+
+	// a new token is requested, so that the link doesn't expire with the token used for the mount
+	token, err := d.newTokenSource().Token()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return "", fmt.Errorf("Could not get an access token for the link of %v", target)
+	}
+	if !token.Expiry.IsZero() && time.Until(token.Expiry) < ttl {
+		return "", fmt.Errorf("Could not create a link valid for %v, access tokens expire after %v",
+			ttl, time.Until(token.Expiry).Round(time.Minute))
+	}
+
+	link := object.GetDownloadURL()
+	separator := "?"
+	if strings.Contains(link, "?") {
+		separator = "&"
+	}
+	Log.Infof("Created a temporary link for %v (%v) valid until %v", object.ObjectID, object.Name, token.Expiry)
+	return link + separator + "access_token=" + url.QueryEscape(token.AccessToken), nil
+}
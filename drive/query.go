@@ -0,0 +1,55 @@
+package drive
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// GetObjectsByQuery lists all (not trashed) files matching the Drive search query
+// (e.g. "name contains '.mkv' and modifiedTime > '2020-01-01T00:00:00'") from the API,
+// shortcuts are resolved and the results are not stored in the cache (when a page fails the
+// objects listed so far are returned with ErrIncompleteListing)
+func (d *Client) GetObjectsByQuery(q string) ([]*APIObject, error) {
+	if err := validateQuery(q); nil != err {
+		return nil, err
+	}
+
+	Log.Debugf("Querying objects %v", q)
+	objects, err := d.listFiles(fmt.Sprintf("(%v) and trashed = false", q), fmt.Sprintf("objects matching %v", q))
+	return filterObjects(d.resolveShortcuts(objects)), err
+}
+
+// validateQuery checks that all strings (in single quotes, \' and \\ are escaped) and
+// parentheses of the query are closed, so that the query can't break out of its condition
+func validateQuery(q string) error {
+	if "" == strings.TrimSpace(q) {
+		return fmt.Errorf("Query must not be empty")
+	}
+
+	quoted := false
+	depth := 0
+	for i := 0; i < len(q); i++ {
+		switch {
+		case quoted && '\\' == q[i]:
+			i++
+		case '\'' == q[i]:
+			quoted = !quoted
+		case !quoted && '(' == q[i]:
+			depth++
+		case !quoted && ')' == q[i]:
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("Query %v closes a parenthesis that hasn't been opened", q)
+			}
+		}
+	}
+	if quoted {
+		return fmt.Errorf("Query %v has an unterminated string", q)
+	}
+	if 0 != depth {
+		return fmt.Errorf("Query %v has an unclosed parenthesis", q)
+	}
+	return nil
+}
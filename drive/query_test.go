@@ -0,0 +1,49 @@
+package drive
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidateQuery(t *testing.T) {
+	for _, q := range []string{
+		"name contains '.mkv'",
+		"name = 'Bob\\'s movie.mkv' and (mimeType = 'video/mp4' or mimeType = 'video/x-matroska')",
+		"name contains ')'",
+	} {
+		if err := validateQuery(q); nil != err {
+			t.Fatalf("Expected query %v to be valid got %v", q, err)
+		}
+	}
+
+	for _, q := range []string{
+		"",
+		"name contains '.mkv",
+		"name contains 'a\\'",
+		"(name contains '.mkv'",
+		"name contains '.mkv') or (trashed = true",
+	} {
+		if err := validateQuery(q); nil == err {
+			t.Fatalf("Expected query %v to be rejected", q)
+		}
+	}
+}
+
+func TestGetObjectsByQuery(t *testing.T) {
+	handler := func(r *http.Request) (int, string) {
+		if q := r.URL.Query().Get("q"); "(name contains '.mkv') and trashed = false" != q {
+			t.Fatalf("Expected the query to exclude trashed files got %v", q)
+		}
+		body := `{"files": [{"id": "1", "name": "movie.mkv", "mimeType": "video/x-matroska", "parents": ["a"], "capabilities": {}}]}`
+		return 200, body
+	}
+	client := newTestClient(nil, handler)
+
+	objects, err := client.GetObjectsByQuery("name contains '.mkv'")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(objects) || "1" != objects[0].ObjectID {
+		t.Fatalf("Expected the matching object got %v", objects)
+	}
+}
@@ -0,0 +1,191 @@
+package drive
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/claudetech/loggo/default"
+
+	"github.com/boltdb/bolt"
+)
+
+// sqliteHeader is the beginning of every SQLite database file
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// replicaBatchSize is the number of objects copied from a replica in one transaction
+const replicaBatchSize = 1000
+
+// Replica is the read only cache of another instance an empty cache is filled from before
+// the first change check (nil = the cache is built from Google Drive), it is closed after the copy
+var Replica ReplicaCache
+
+// ReplicaCache is a read only cache of another plexdrive instance, an empty cache is filled
+// from it instead of listing all changes of Google Drive
+type ReplicaCache interface {
+	// ForEachObject calls fn for every cached object
+	ForEachObject(fn func(object *APIObject) error) error
+	// GetStartPageToken gets the page token the replica has been updated to
+	GetStartPageToken() (string, error)
+	// LoadSource loads the root folder and drive the replica is built for (nil if unknown)
+	LoadSource() (*CacheSource, error)
+	// Close closes all handles
+	Close() error
+}
+
+// OpenReplicaCache opens a cache file of another instance read only, the backend (bolt or
+// sqlite) is detected by the file header and the schema version has to match this version
+func OpenReplicaCache(cacheFile string) (ReplicaCache, error) {
+	file, err := os.Open(cacheFile)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open replica cache file %v", cacheFile)
+	}
+	header := make([]byte, len(sqliteHeader))
+	_, err = io.ReadFull(file, header)
+	file.Close()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read replica cache file %v", cacheFile)
+	}
+
+	if bytes.Equal(sqliteHeader, header) {
+		return openSQLiteReplica(cacheFile)
+	}
+	return openBoltReplica(cacheFile)
+}
+
+// openSQLiteReplica opens a sqlite cache file read only, it can be used by its instance meanwhile
+func openSQLiteReplica(cacheFile string) (ReplicaCache, error) {
+	db, err := sql.Open("sqlite3", "file:"+cacheFile+"?mode=ro&_busy_timeout=5000")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open replica cache file %v", cacheFile)
+	}
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); nil != err {
+		Log.Debugf("%v", err)
+		db.Close()
+		return nil, fmt.Errorf("Could not read replica cache file %v", cacheFile)
+	}
+	if sqliteSchemaVersion != version {
+		db.Close()
+		return nil, fmt.Errorf("Replica cache file %v has schema version %v instead of %v", cacheFile, version, sqliteSchemaVersion)
+	}
+
+	return &SQLiteCache{db: db}, nil
+}
+
+// openBoltReplica opens a bolt cache file read only, bolt files are locked by their instance,
+// so this has to be a copy
+func openBoltReplica(cacheFile string) (ReplicaCache, error) {
+	db, err := bolt.Open(cacheFile, 0600, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: true})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open replica cache file %v (use a copy of the cache file of a running plexdrive process)", cacheFile)
+	}
+
+	var version string
+	db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(bMeta); nil != meta {
+			version = string(meta.Get([]byte("version")))
+		}
+		return nil
+	})
+	if boltSchemaVersion != version {
+		db.Close()
+		return nil, fmt.Errorf("Replica cache file %v has schema version %v instead of %v", cacheFile, version, boltSchemaVersion)
+	}
+
+	return &BoltCache{db: db}, nil
+}
+
+// storeCacheSource stores the root folder and drive of the client in a cache that has no
+// source yet, so that the cache file can be used as replica by other instances
+func (d *Client) storeCacheSource() error {
+	if source, err := d.cache.LoadSource(); nil != err || nil != source {
+		return err
+	}
+	source, err := d.cacheSource()
+	if nil != err {
+		return err
+	}
+	return d.cache.StoreSource(source)
+}
+
+// cacheSource gets the root folder and drive of the client
+func (d *Client) cacheSource() (*CacheSource, error) {
+	root, err := d.getRootObject()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get root object")
+	}
+	return &CacheSource{Root: root.ObjectID, DriveID: d.driveID}, nil
+}
+
+// fillFromReplica copies all objects and the page token of the replica into the cache
+// if it has not been built yet, the changes since the replica was updated are fetched
+// with the next change check. The replica has to be built for the same root folder and
+// drive, otherwise it would serve the objects of another account or folder. The page
+// token is stored last, so that an interrupted copy is started again.
+func (d *Client) fillFromReplica(replica ReplicaCache) error {
+	cache := d.cache
+	if _, err := cache.GetStartPageToken(); nil == err {
+		Log.Debugf("Cache has already been built, not using the replica")
+		return nil
+	}
+	pageToken, err := replica.GetStartPageToken()
+	if nil != err {
+		return fmt.Errorf("Replica cache has not been built yet")
+	}
+
+	expected, err := d.cacheSource()
+	if nil != err {
+		return err
+	}
+	source, err := replica.LoadSource()
+	if nil != err {
+		return err
+	}
+	if nil == source {
+		return fmt.Errorf("Replica cache has no root folder and drive (it has been built by an older version)")
+	}
+	if *expected != *source {
+		return fmt.Errorf("Replica cache has been built for root %v (drive %v) instead of %v (drive %v)",
+			source.Root, source.DriveID, expected.Root, expected.DriveID)
+	}
+
+	Log.Infof("Filling cache from replica...")
+	batch := make([]*APIObject, 0, replicaBatchSize)
+	copied := 0
+	var storeErr error
+	err = replica.ForEachObject(func(object *APIObject) error {
+		batch = append(batch, object)
+		if len(batch) < replicaBatchSize {
+			return nil
+		}
+		storeErr = cache.BatchUpdateObjects(batch)
+		copied += len(batch)
+		batch = batch[:0]
+		return storeErr
+	})
+	if nil != storeErr {
+		return storeErr
+	}
+	if nil != err {
+		return err
+	}
+	if err := cache.BatchUpdateObjects(batch); nil != err {
+		return err
+	}
+	copied += len(batch)
+
+	if err := cache.StoreStartPageToken(pageToken); nil != err {
+		return err
+	}
+	Log.Infof("Copied %v objects from replica", copied)
+	return nil
+}
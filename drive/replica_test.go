@@ -0,0 +1,91 @@
+package drive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFillFromReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-replica")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	objects := []*APIObject{
+		{ObjectID: "folder", Name: "Movies", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "movie", Name: "movie.mkv", Parents: []string{"folder"}},
+	}
+
+	// the sqlite replica is still open by its instance, the bolt replica is a closed copy
+	source, err := NewSQLiteCache(filepath.Join(dir, "replica.sqlite"), dir, nil, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	source.ApplyChanges(objects, nil, "42")
+	source.StoreSource(&CacheSource{Root: "root-id"})
+
+	boltSource, err := NewBoltCache(filepath.Join(dir, "replica.bolt"), dir, nil, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	boltSource.ApplyChanges(objects, nil, "42")
+	boltSource.StoreSource(&CacheSource{Root: "root-id"})
+	boltSource.Close()
+
+	for _, file := range []string{"replica.sqlite", "replica.bolt"} {
+		cache, cleanup := newTestCache(t)
+		defer cleanup()
+
+		replica, err := OpenReplicaCache(filepath.Join(dir, file))
+		if nil != err {
+			t.Fatal(err)
+		}
+		if err := newTestClient(cache, nil).fillFromReplica(replica); nil != err {
+			t.Fatal(err)
+		}
+		replica.Close()
+
+		if token, err := cache.GetStartPageToken(); nil != err || "42" != token {
+			t.Fatalf("Expected the page token of the replica %v got %v (%v)", file, token, err)
+		}
+		if child, err := cache.GetObjectByParentAndName("folder", "movie.mkv"); nil != err || "movie" != child.ObjectID {
+			t.Fatalf("Expected the objects of the replica %v got %v (%v)", file, child, err)
+		}
+	}
+
+	// a built cache is kept
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+	cache.StoreStartPageToken("50")
+	replica, err := OpenReplicaCache(filepath.Join(dir, "replica.sqlite"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	if err := newTestClient(cache, nil).fillFromReplica(replica); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetObject("movie"); nil == err {
+		t.Fatalf("Expected a built cache not to be filled from the replica")
+	}
+
+	// a replica of another drive is refused
+	other, cleanupOther := newTestSQLiteCache(t)
+	defer cleanupOther()
+	client := newTestClient(other, nil)
+	client.driveID = "other-drive"
+	if err := client.fillFromReplica(replica); nil == err {
+		t.Fatalf("Expected a replica of another drive to be refused")
+	}
+	if _, err := other.GetObject("movie"); nil == err {
+		t.Fatalf("Expected a refused replica not to be copied")
+	}
+
+	if _, err := OpenReplicaCache(filepath.Join(dir, "missing")); nil == err {
+		t.Fatalf("Expected a missing replica to be rejected")
+	}
+}
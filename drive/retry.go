@@ -0,0 +1,106 @@
+package drive
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/dweidenfeld/plexdrive/metrics"
+	"google.golang.org/api/googleapi"
+)
+
+// maxRetryDelay is the maximum time to wait between two attempts of an API call
+const maxRetryDelay = 32 * time.Second
+
+// MaxAttempts is the number of times a throttled or failing API call is sent
+// before the error is returned to the caller
+var MaxAttempts = 6
+
+// doWithRetry executes the API call and retries it with an exponential backoff
+// (plus jitter) as long as Google Drive responds with a rate limit or server error,
+// the wait time of a Retry-After header is used instead of the backoff, all other
+// errors (e.g. not found or forbidden) are returned immediately. The description of the
+// call (e.g. "get object <id>") is part of the logs.
+func doWithRetry(description string, call func() error) error {
+	delay := 1 * time.Second
+	for attempt := 1; ; attempt++ {
+		metrics.APIRequests.WithLabelValues("metadata").Inc()
+		err := call()
+		if nil == err || !isRetryableError(err) {
+			return err
+		}
+		if attempt >= MaxAttempts {
+			Log.Warningf("Could not %v, Google Drive API is still throttling or unavailable, giving up after %v attempts: %v",
+				description, attempt, err)
+			return err
+		}
+
+		wait := delay + time.Duration(rand.Int63n(int64(delay)))
+		if retryAfter := getRetryAfter(err, time.Now()); retryAfter > 0 {
+			wait = retryAfter
+		}
+		Log.Debugf("%v", err)
+		Log.Infof("Google Drive API is throttling or unavailable, retrying to %v in %v", description, wait)
+		time.Sleep(wait)
+		if delay < maxRetryDelay {
+			delay *= 2
+		}
+	}
+}
+
+// getRetryAfter gets the wait time of the Retry-After header (in seconds or as HTTP date)
+// of an API error, 0 is returned if the header isn't set
+func getRetryAfter(err error, now time.Time) time.Duration {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || nil == apiErr.Header {
+		return 0
+	}
+
+	value := apiErr.Header.Get("Retry-After")
+	if "" == value {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); nil == err && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); nil == err && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// isNotFoundError checks if the API responded with 404 not found
+func isNotFoundError(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && 404 == apiErr.Code
+}
+
+// isRetryableError checks if the error is a rate limit, server error or timeout
+func isRetryableError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	if 429 == apiErr.Code || apiErr.Code >= 500 {
+		return true
+	}
+	if 403 == apiErr.Code {
+		for _, item := range apiErr.Errors {
+			switch item.Reason {
+			case "userRateLimitExceeded", "rateLimitExceeded", "dailyLimitExceeded":
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package drive
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestGetRetryAfter(t *testing.T) {
+	now := time.Date(2017, 3, 4, 12, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"":                              0,
+		"5":                             5 * time.Second,
+		"invalid":                       0,
+		"Sat, 04 Mar 2017 12:00:30 GMT": 30 * time.Second,
+		"Sat, 04 Mar 2017 11:00:00 GMT": 0,
+	} {
+		err := &googleapi.Error{Code: 429, Header: http.Header{}}
+		if "" != value {
+			err.Header.Set("Retry-After", value)
+		}
+		if actual := getRetryAfter(err, now); expected != actual {
+			t.Fatalf("Expected %v for Retry-After %v got %v", expected, value, actual)
+		}
+	}
+}
+
+func TestDoWithRetryFailsFast(t *testing.T) {
+	maxAttempts := MaxAttempts
+	MaxAttempts = 1
+	defer func() { MaxAttempts = maxAttempts }()
+
+	for _, code := range []int{404, 503} {
+		calls := 0
+		err := doWithRetry("test", func() error {
+			calls++
+			return &googleapi.Error{Code: code}
+		})
+		if nil == err || 1 != calls {
+			t.Fatalf("Expected one call for status %v got %v (%v)", code, calls, err)
+		}
+	}
+}
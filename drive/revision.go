@@ -0,0 +1,306 @@
+package drive
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	gdrive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// ShowVersions shows the revisions of the files of every folder in a hidden .versions folder
+var ShowVersions bool
+
+// versionsFolderName is the name of the hidden folder with the revisions of the files of a folder
+const versionsFolderName = ".versions"
+
+// The prefixes of the virtual objects of the versions folders: the .versions folder of a folder,
+// the folder with the revisions of a file and a single revision
+const (
+	versionsFolderPrefix  = "plexdrive-versions:"
+	revisionsFolderPrefix = "plexdrive-revisions:"
+	revisionObjectPrefix  = "plexdrive-revision:"
+)
+
+// revisionFields are the fields of a revision requested from the API
+const revisionFields = "id, mimeType, modifiedTime, size, md5Checksum, keepForever"
+
+// revisionNameTimeLayout is the layout of the time added to the name of a revision
+// (without colons, they are not allowed in names on all platforms)
+const revisionNameTimeLayout = "2006-01-02 15.04.05"
+
+// revisionsCacheDuration is the time the listed revisions of a file are reused
+const revisionsCacheDuration = time.Minute
+
+// ErrRevisionsNotSupported is returned for files whose revisions can't be read (e.g. Google Docs)
+var ErrRevisionsNotSupported = errors.New("The revisions of the file can't be read")
+
+// Revision is a stored version of the content of a file
+type Revision struct {
+	RevisionID   string
+	MimeType     string
+	Size         uint64
+	MD5          string
+	LastModified time.Time
+	KeepForever  bool
+}
+
+// cachedRevisions are the revisions of a file (or the error that they are not supported)
+// listed at listedAt for the modification time of the file
+type cachedRevisions struct {
+	revisions    []*Revision
+	err          error
+	lastModified time.Time
+	listedAt     time.Time
+}
+
+// getRevisions gets the revisions of the file, they are reused for a short time so that the
+// lookups in the revisions folder don't list them again (they are listed again once the file
+// has been modified)
+func (d *Client) getRevisions(file *APIObject) ([]*Revision, error) {
+	d.revisionsLock.Lock()
+	cached, exists := d.revisions[file.ObjectID]
+	d.revisionsLock.Unlock()
+	if exists && time.Since(cached.listedAt) < revisionsCacheDuration && cached.lastModified.Equal(file.LastModified) {
+		return cached.revisions, cached.err
+	}
+
+	revisions, err := d.ListRevisions(file.ObjectID)
+	if nil != err && !errors.Is(err, ErrRevisionsNotSupported) {
+		return nil, err
+	}
+
+	d.revisionsLock.Lock()
+	defer d.revisionsLock.Unlock()
+	if nil == d.revisions {
+		d.revisions = make(map[string]cachedRevisions)
+	}
+	for id, cached := range d.revisions {
+		if time.Since(cached.listedAt) >= revisionsCacheDuration {
+			delete(d.revisions, id)
+		}
+	}
+	d.revisions[file.ObjectID] = cachedRevisions{
+		revisions:    revisions,
+		err:          err,
+		lastModified: file.LastModified,
+		listedAt:     time.Now(),
+	}
+	return revisions, err
+}
+
+// ListRevisions gets all stored revisions of the file from the API (the oldest first), the
+// current content is the last revision
+func (d *Client) ListRevisions(id string) ([]*Revision, error) {
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	revisions := make([]*Revision, 0)
+	pageToken := ""
+	for {
+		var results *gdrive.RevisionList
+		err := doWithRetry(fmt.Sprintf("list revisions of %v", id), func() error {
+			var err error
+			results, err = client.Revisions.List(id).
+				Fields(googleapi.Field(fmt.Sprintf("nextPageToken, revisions(%v)", revisionFields))).
+				PageSize(int64(PageSize)).
+				PageToken(pageToken).
+				Do()
+			return err
+		})
+		if nil != err {
+			return nil, revisionError(id, err)
+		}
+
+		for _, revision := range results.Revisions {
+			revisions = append(revisions, mapRevision(revision))
+		}
+		if "" == results.NextPageToken {
+			return revisions, nil
+		}
+		pageToken = results.NextPageToken
+	}
+}
+
+// GetRevisionObject gets a revision of the file as object that can be read like the file itself
+func (d *Client) GetRevisionObject(id, revisionID string) (*APIObject, error) {
+	file, err := d.getObjectOrRoot(id)
+	if nil != err {
+		return nil, err
+	}
+	if "" != file.ExportMimeType {
+		return nil, fmt.Errorf("Could not get revision %v of %v (%v): %w", revisionID, file.ObjectID, file.Name, ErrRevisionsNotSupported)
+	}
+
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	var revision *gdrive.Revision
+	err = doWithRetry(fmt.Sprintf("get revision %v of %v", revisionID, id), func() error {
+		var err error
+		revision, err = client.Revisions.Get(id, revisionID).Fields(googleapi.Field(revisionFields)).Do()
+		return err
+	})
+	if nil != err {
+		return nil, revisionError(id, err)
+	}
+
+	return revisionToObject(file, mapRevision(revision), revisionsFolderPrefix+id), nil
+}
+
+// revisionError maps an API error of a revision request
+func revisionError(id string, err error) error {
+	Log.Debugf("%v", err)
+	if isNotFoundError(err) {
+		return fmt.Errorf("Could not find revisions of %v in API: %w", id, ErrNotFound)
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && 403 == apiErr.Code {
+		for _, item := range apiErr.Errors {
+			if "revisionsNotSupported" == item.Reason {
+				return fmt.Errorf("Could not get revisions of %v: %w", id, ErrRevisionsNotSupported)
+			}
+		}
+	}
+	return fmt.Errorf("Could not get revisions of %v from API", id)
+}
+
+// mapRevision maps a Google Drive revision to Revision
+func mapRevision(revision *gdrive.Revision) *Revision {
+	lastModified, err := time.Parse(time.RFC3339, revision.ModifiedTime)
+	if nil != err {
+		Log.Debugf("%v", err)
+		lastModified = time.Unix(0, 0).UTC()
+	}
+	return &Revision{
+		RevisionID:   revision.Id,
+		MimeType:     revision.MimeType,
+		Size:         uint64(revision.Size),
+		MD5:          revision.Md5Checksum,
+		LastModified: lastModified,
+		KeepForever:  revision.KeepForever,
+	}
+}
+
+// revisionToObject creates the read only object of a revision, the time of the revision is
+// added to the name of the file (e.g. movie (2020-01-02 15.04.05).mkv)
+func revisionToObject(file *APIObject, revision *Revision, parent string) *APIObject {
+	extension := path.Ext(file.Name)
+	return &APIObject{
+		ObjectID: revisionObjectPrefix + file.ObjectID + "@" + revision.RevisionID,
+		Name: fmt.Sprintf("%v (%v)%v", strings.TrimSuffix(file.Name, extension),
+			revision.LastModified.UTC().Format(revisionNameTimeLayout), extension),
+		LastModified: revision.LastModified,
+		Size:         revision.Size,
+		MD5:          revision.MD5,
+		MimeType:     revision.MimeType,
+		DownloadURL:  fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%v/revisions/%v?alt=media", file.ObjectID, revision.RevisionID),
+		Parents:      []string{parent},
+		CachedAt:     time.Now(),
+	}
+}
+
+// isVersionID checks if the id belongs to a virtual object of the versions folders
+func isVersionID(id string) bool {
+	return strings.HasPrefix(id, versionsFolderPrefix) ||
+		strings.HasPrefix(id, revisionsFolderPrefix) ||
+		strings.HasPrefix(id, revisionObjectPrefix)
+}
+
+// getVersionsFolder gets the hidden versions folder of a folder if versions are shown
+func (d *Client) getVersionsFolder(parent string) *APIObject {
+	if !ShowVersions || SharedFolderID == parent || TrashFolderID == parent || isVersionID(parent) {
+		return nil
+	}
+
+	folder, err := d.getObjectOrRoot(parent)
+	if nil != err {
+		return nil
+	}
+	return &APIObject{
+		ObjectID:     versionsFolderPrefix + parent,
+		Name:         versionsFolderName,
+		IsDir:        true,
+		LastModified: folder.LastModified,
+		Parents:      []string{parent},
+	}
+}
+
+// getVersionObjects gets the children of a virtual versions folder: a folder for every file of
+// the folder in a .versions folder and the revisions in the folder of a file, files without
+// readable revisions have an empty folder
+func (d *Client) getVersionObjects(parent string) ([]*APIObject, error) {
+	if id := strings.TrimPrefix(parent, revisionsFolderPrefix); id != parent {
+		file, err := d.getObjectOrRoot(id)
+		if nil != err {
+			return nil, err
+		}
+		revisions, err := d.getRevisions(file)
+		if errors.Is(err, ErrRevisionsNotSupported) {
+			Log.Debugf("%v", err)
+			return []*APIObject{}, nil
+		}
+		if nil != err {
+			return nil, err
+		}
+
+		objects := make([]*APIObject, 0, len(revisions))
+		for _, revision := range revisions {
+			objects = append(objects, revisionToObject(file, revision, parent))
+		}
+		return renameDuplicates(objects), nil
+	}
+
+	folder := strings.TrimPrefix(parent, versionsFolderPrefix)
+	if folder == parent {
+		return nil, fmt.Errorf("Could not find versions folder %v: %w", parent, ErrNotFound)
+	}
+	children, err := d.GetObjectsByParent(folder)
+	if nil != err {
+		return nil, err
+	}
+
+	objects := make([]*APIObject, 0, len(children))
+	for _, child := range children {
+		// the revisions of a shortcut are the revisions of its target
+		id := child.ObjectID
+		if "" != child.ShortcutTargetID {
+			id = child.ShortcutTargetID
+		}
+		if child.IsDir || "" != child.ExportMimeType || isVersionID(id) {
+			continue
+		}
+		objects = append(objects, &APIObject{
+			ObjectID:     revisionsFolderPrefix + id,
+			Name:         child.Name,
+			IsDir:        true,
+			LastModified: child.LastModified,
+			Parents:      []string{parent},
+		})
+	}
+	return objects, nil
+}
+
+// getVersionChild gets a child of a virtual versions folder by name
+func (d *Client) getVersionChild(parent, name string) (*APIObject, error) {
+	objects, err := d.getVersionObjects(parent)
+	if nil != err {
+		return nil, err
+	}
+	for _, object := range objects {
+		if object.Name == name {
+			return object, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find %v in versions folder %v: %w", name, parent, ErrNotFound)
+}
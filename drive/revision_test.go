@@ -0,0 +1,79 @@
+package drive
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVersionsFolder(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "movie", Name: "movie.mkv", Parents: []string{"root-id"}},
+		{ObjectID: "other", Name: "other.mkv", Parents: []string{"root-id"}},
+		{ObjectID: "doc", Name: "notes", ExportMimeType: "application/pdf", Parents: []string{"root-id"}},
+	})
+	listings := 0
+	handler := func(r *http.Request) (int, string) {
+		if strings.Contains(r.URL.Path, "/files/movie/") {
+			listings++
+		}
+		status, body := 200, `{"revisions": [
+			{"id": "1", "modifiedTime": "2020-01-02T15:04:05Z", "size": "10", "md5Checksum": "abc"},
+			{"id": "2", "modifiedTime": "2020-02-03T10:00:00Z", "size": "20"}
+		]}`
+		if strings.Contains(r.URL.Path, "/files/other/") {
+			status, body = 403, `{"error": {"code": 403, "errors": [{"reason": "revisionsNotSupported"}]}}`
+		}
+		return status, body
+	}
+	client := newTestClient(cache, handler)
+
+	if _, err := client.GetObjectByParentAndName("root-id", versionsFolderName); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected no versions folder by default got %v", err)
+	}
+
+	ShowVersions = true
+	defer func() { ShowVersions = false }()
+
+	versions, err := client.GetObjectByParentAndName("root-id", versionsFolderName)
+	if nil != err || !versions.IsDir {
+		t.Fatalf("Expected the versions folder got %v (%v)", versions, err)
+	}
+	files, err := client.GetObjectsByParent(versions.ObjectID)
+	if nil != err || 2 != len(files) {
+		t.Fatalf("Expected a folder for every file except the document got %v (%v)", files, err)
+	}
+
+	movie, err := client.GetObjectByParentAndName(versions.ObjectID, "movie.mkv")
+	if nil != err {
+		t.Fatal(err)
+	}
+	revisions, err := client.GetObjectsByParent(movie.ObjectID)
+	if nil != err || 2 != len(revisions) {
+		t.Fatalf("Expected both revisions got %v (%v)", revisions, err)
+	}
+	if "movie (2020-01-02 15.04.05).mkv" != revisions[0].Name || 10 != revisions[0].Size ||
+		"https://www.googleapis.com/drive/v3/files/movie/revisions/1?alt=media" != revisions[0].GetDownloadURL() {
+		t.Fatalf("Expected the first revision got %v", revisions[0])
+	}
+
+	if _, err := client.GetObjectByParentAndName(movie.ObjectID, revisions[1].Name); nil != err || 1 != listings {
+		t.Fatalf("Expected the listed revisions to be reused for lookups got %v listings (%v)", listings, err)
+	}
+
+	other, err := client.GetObjectByParentAndName(versions.ObjectID, "other.mkv")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if revisions, err := client.GetObjectsByParent(other.ObjectID); nil != err || 0 != len(revisions) {
+		t.Fatalf("Expected no revisions of a file without revisions got %v (%v)", revisions, err)
+	}
+
+	if err := client.Remove(revisions[0], movie.ObjectID); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected revisions to be read only got %v", err)
+	}
+}
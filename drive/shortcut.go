@@ -0,0 +1,97 @@
+package drive
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// shortcutMimeType is the mime type of Google Drive shortcuts
+const shortcutMimeType = "application/vnd.google-apps.shortcut"
+
+// missingTargetRetry is the time until a broken shortcut is resolved again
+const missingTargetRetry = 10 * time.Minute
+
+// resolveShortcuts resolves all shortcuts to their targets, broken shortcuts are dropped
+func (d *Client) resolveShortcuts(objects []*APIObject) []*APIObject {
+	resolved := make([]*APIObject, 0, len(objects))
+	for _, object := range objects {
+		if o, err := d.resolveShortcut(object); nil == err {
+			resolved = append(resolved, o)
+		} else {
+			Log.Debugf("%v", err)
+		}
+	}
+	return resolved
+}
+
+// resolveShortcut makes a shortcut behave like its target (type, size and content), the shortcut
+// keeps its own id so that renaming or removing it doesn't touch the target
+func (d *Client) resolveShortcut(object *APIObject) (*APIObject, error) {
+	if "" == object.ShortcutTargetID {
+		return object, nil
+	}
+
+	target, err := d.getShortcutTarget(object.ShortcutTargetID)
+	if nil != err {
+		return nil, fmt.Errorf("Could not resolve shortcut %v (%v): %w", object.ObjectID, object.Name, err)
+	}
+
+	object.IsDir = target.IsDir
+	object.Size = target.Size
+	object.LastModified = target.LastModified
+	object.MTime = target.MTime
+	object.DownloadURL = target.DownloadURL
+	object.MimeType = target.MimeType
+	object.MD5 = target.MD5
+	object.ExportMimeType = target.ExportMimeType
+	object.Video = target.Video
+	return object, nil
+}
+
+// contentID gets the id of the folder whose children should be listed for the object
+// (the target of a folder shortcut)
+func (d *Client) contentID(id string) string {
+	object, err := d.cache.GetObject(id)
+	if nil != err || "" == object.ShortcutTargetID {
+		return id
+	}
+	return object.ShortcutTargetID
+}
+
+// getShortcutTarget gets the target from the cache or the API, fetched targets are
+// stored in the cache and missing targets are remembered for a while (other errors
+// are returned as they are, the target is fetched again with the next lookup)
+func (d *Client) getShortcutTarget(id string) (*APIObject, error) {
+	if target, err := d.cache.GetObject(id); nil == err {
+		return target, nil
+	}
+
+	d.shortcutLock.Lock()
+	missingSince, missing := d.missingTargets[id]
+	d.shortcutLock.Unlock()
+	if missing && time.Since(missingSince) < missingTargetRetry {
+		return nil, fmt.Errorf("Shortcut target %v is missing: %w", id, ErrNotFound)
+	}
+	if d.IsDegraded() {
+		return nil, fmt.Errorf("Could not get shortcut target %v: %w", id, ErrDegraded)
+	}
+
+	target, err := d.getObjectFromAPI(id)
+	if errors.Is(err, ErrNotFound) {
+		Log.Debugf("%v", err)
+		d.shortcutLock.Lock()
+		d.missingTargets[id] = time.Now()
+		d.shortcutLock.Unlock()
+		return nil, fmt.Errorf("Could not get shortcut target %v from API: %w", id, ErrNotFound)
+	}
+	if nil != err {
+		return nil, err
+	}
+	if err := d.cache.UpdateObject(target); nil != err {
+		Log.Warningf("%v", err)
+	}
+	return target, nil
+}
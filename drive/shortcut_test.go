@@ -0,0 +1,66 @@
+package drive
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShortcutTargetErrors(t *testing.T) {
+	maxAttempts := MaxAttempts
+	MaxAttempts = 1
+	defer func() { MaxAttempts = maxAttempts }()
+
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	status := 500
+	client := newTestClient(cache, func(r *http.Request) (int, string) {
+		return status, fmt.Sprintf(`{"error": {"code": %v, "message": "error"}}`, status)
+	})
+
+	// a failing request isn't remembered, the target is fetched again on the next lookup
+	if _, err := client.getShortcutTarget("target"); nil == err || errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected a failing request not to be reported as missing target got %v", err)
+	}
+	if _, missing := client.missingTargets["target"]; missing {
+		t.Fatalf("Expected the target not to be remembered as missing after a failing request")
+	}
+
+	status = 404
+	if _, err := client.getShortcutTarget("target"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected the deleted target to be missing got %v", err)
+	}
+	if _, missing := client.missingTargets["target"]; !missing {
+		t.Fatalf("Expected the deleted target to be remembered as missing")
+	}
+}
+
+func TestShortcutResolution(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "target", Name: "movie.mkv", Size: 42, DownloadURL: "url", Parents: []string{"a"}},
+		{ObjectID: "folder", Name: "Movies", IsDir: true, Parents: []string{"a"}},
+		{ObjectID: "child", Name: "child.mkv", Parents: []string{"folder"}},
+		{ObjectID: "1", Name: "shortcut.mkv", Parents: []string{"b"}, ShortcutTargetID: "target"},
+		{ObjectID: "2", Name: "Shortcut", IsDir: true, Parents: []string{"b"}, ShortcutTargetID: "folder"},
+	})
+	client := &Client{cache: cache, rootNodeID: "root-id", missingTargets: make(map[string]time.Time)}
+
+	object, err := client.GetObjectByParentAndName("b", "shortcut.mkv")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "1" != object.ObjectID || 42 != object.Size || "url" != object.DownloadURL {
+		t.Fatalf("Expected the shortcut to behave like the target got %v", object)
+	}
+
+	children, _ := client.GetObjectsByParent("2")
+	if 1 != len(children) || "child" != children[0].ObjectID {
+		t.Fatalf("Expected the children of the target folder got %v", children)
+	}
+}
@@ -0,0 +1,57 @@
+package drive
+
+import (
+	"fmt"
+	"strings"
+
+	gdrive "google.golang.org/api/drive/v3"
+)
+
+// The spaces of Google Drive that can be listed
+const (
+	SpaceDrive  = "drive"
+	SpacePhotos = "photos"
+)
+
+// Spaces is the comma separated list of spaces files and changes are listed from
+// (empty = the default space drive)
+var Spaces string
+
+// ValidateSpaces checks that the comma separated spaces can be listed
+func ValidateSpaces(spaces string) error {
+	if "" == spaces {
+		return nil
+	}
+	for _, space := range strings.Split(spaces, ",") {
+		switch strings.TrimSpace(space) {
+		case SpaceDrive, SpacePhotos:
+		default:
+			return fmt.Errorf("Invalid space %v (drive or photos)", space)
+		}
+	}
+	return nil
+}
+
+// hasSpace checks if the space is listed
+func hasSpace(space string) bool {
+	for _, s := range strings.Split(Spaces, ",") {
+		if strings.TrimSpace(s) == space {
+			return true
+		}
+	}
+	return false
+}
+
+// isPhotosOnly checks if the file only exists in the Google Photos space, these files have
+// no parent (they are shown in the shared folder) and can't be changed through Google Drive
+func isPhotosOnly(file *gdrive.File) bool {
+	if 0 == len(file.Spaces) {
+		return false
+	}
+	for _, space := range file.Spaces {
+		if SpacePhotos != space {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package drive
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestValidateSpaces(t *testing.T) {
+	for _, spaces := range []string{"", "drive", "photos", "drive,photos"} {
+		if err := ValidateSpaces(spaces); nil != err {
+			t.Fatalf("Expected %v to be valid got %v", spaces, err)
+		}
+	}
+	if err := ValidateSpaces("drive,appDataFolder"); nil == err {
+		t.Fatalf("Expected appDataFolder to be rejected")
+	}
+}
+
+func TestPhotosSpace(t *testing.T) {
+	Spaces = "drive,photos"
+	defer func() { Spaces = "" }()
+
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	var spaces string
+	handler := func(r *http.Request) (int, string) {
+		spaces = r.URL.Query().Get("spaces")
+		return 200, `{"files": [
+				{"id": "photo", "name": "IMG_0001.JPG", "mimeType": "image/jpeg", "spaces": ["photos"]},
+				{"id": "file", "name": "movie.mkv", "mimeType": "video/x-matroska", "parents": ["root-id"], "spaces": ["drive", "photos"], "capabilities": {"canTrash": true}}]}`
+	}
+	client := newTestClient(cache, handler)
+
+	objects, err := client.listFiles("trashed = false", "files")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "drive,photos" != spaces {
+		t.Fatalf("Expected the spaces to be listed got %v", spaces)
+	}
+	if 2 != len(objects) || !objects[0].Photos || objects[0].CanTrash || objects[1].Photos || !objects[1].CanTrash {
+		t.Fatalf("Expected only the photo to be read only got %v %v", objects[0], objects[1])
+	}
+
+	if err := client.Rename(objects[0], SharedFolderID, "root-id", "photo.jpg"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected renaming a photo to be rejected got %v", err)
+	}
+	if err := client.Remove(objects[0], SharedFolderID); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected removing a photo to be rejected got %v", err)
+	}
+}
@@ -0,0 +1,539 @@
+package drive
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	. "github.com/claudetech/loggo/default"
+
+	// register the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteCache is the cache stored in a SQLite database, children are looked up
+// through an index on the parent id which keeps listings of huge folders fast
+type SQLiteCache struct {
+	*tokenFile
+	db       *sql.DB
+	sqlDebug bool
+	lookups  lookupCounter
+}
+
+// sqliteSchemaVersion is the version of the cache layout (stored as user_version),
+// the cache is rebuilt when the stored version differs
+const sqliteSchemaVersion = 3
+
+// sqliteSchema creates all tables and indexes
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS objects (
+	id   TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS parents (
+	parent_id TEXT NOT NULL,
+	name      TEXT NOT NULL,
+	object_id TEXT NOT NULL,
+	PRIMARY KEY (parent_id, name, object_id)
+);
+CREATE INDEX IF NOT EXISTS idx_parents_object_id ON parents (object_id);
+CREATE TABLE IF NOT EXISTS page_token (
+	id    INTEGER PRIMARY KEY CHECK (id = 1),
+	token TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS crawl_state (
+	id   INTEGER PRIMARY KEY CHECK (id = 1),
+	data BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS source (
+	id   INTEGER PRIMARY KEY CHECK (id = 1),
+	data BLOB NOT NULL
+);
+`
+
+// NewSQLiteCache creates a new cache instance (the token file is encrypted when a token key is given)
+func NewSQLiteCache(cacheFile, configPath string, tokenKey []byte, sqlDebug bool) (*SQLiteCache, error) {
+	Log.Debugf("Opening cache connection")
+
+	db, err := sql.Open("sqlite3", cacheFile+"?_journal_mode=WAL&_busy_timeout=5000")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open cache file")
+	}
+	// sqlite only supports one writer, so serialize everything on one connection
+	db.SetMaxOpenConns(1)
+
+	if err := sqliteMigrate(db); nil != err {
+		Log.Debugf("%v", err)
+		db.Close()
+		return nil, fmt.Errorf("Could not migrate cache schema")
+	}
+
+	if _, err := db.Exec(sqliteSchema); nil != err {
+		Log.Debugf("%v", err)
+		db.Close()
+		return nil, fmt.Errorf("Could not create cache schema")
+	}
+
+	return &SQLiteCache{
+		tokenFile: newTokenFile(configPath, tokenKey),
+		db:        db,
+		sqlDebug:  sqlDebug,
+	}, nil
+}
+
+// Close closes all handles
+func (c *SQLiteCache) Close() error {
+	Log.Debugf("Closing cache file")
+	return c.db.Close()
+}
+
+// trace logs the executed query when sql debugging is enabled
+func (c *SQLiteCache) trace(query string, args ...interface{}) {
+	if c.sqlDebug {
+		Log.Tracef("SQL %v %v", query, args)
+	}
+}
+
+// GetObject gets an object by id
+func (c *SQLiteCache) GetObject(id string) (*APIObject, error) {
+	Log.Tracef("Getting object %v", id)
+
+	object, err := sqliteGetObject(c, c.db, id)
+	c.lookups.count(err)
+	if nil != err {
+		return nil, err
+	}
+
+	Log.Tracef("Got object from cache %v", object)
+	return object, nil
+}
+
+// GetObjects gets all objects for the given ids (unknown ids are skipped)
+func (c *SQLiteCache) GetObjects(ids []string) ([]*APIObject, error) {
+	Log.Tracef("Getting objects %v", ids)
+
+	objects := make([]*APIObject, 0, len(ids))
+	for _, id := range ids {
+		if object, err := sqliteGetObject(c, c.db, id); nil == err {
+			objects = append(objects, object)
+		} else {
+			Log.Tracef("%v", err)
+		}
+	}
+
+	Log.Tracef("Got objects from cache %v", objects)
+	return objects, nil
+}
+
+// GetObjectsByParent get all objects under parent id
+func (c *SQLiteCache) GetObjectsByParent(parent string) ([]*APIObject, error) {
+	Log.Tracef("Getting children for %v", parent)
+
+	query := "SELECT o.data FROM parents p JOIN objects o ON o.id = p.object_id WHERE p.parent_id = ?"
+	c.trace(query, parent)
+	rows, err := c.db.Query(query, parent)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get children of %v from cache", parent)
+	}
+	defer rows.Close()
+
+	objects := make([]*APIObject, 0)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); nil != err {
+			Log.Debugf("%v", err)
+			continue
+		}
+		var object APIObject
+		if err := json.Unmarshal(data, &object); nil != err {
+			Log.Debugf("%v", err)
+			continue
+		}
+		objects = append(objects, &object)
+	}
+
+	Log.Tracef("Got objects from cache %v", objects)
+	return objects, rows.Err()
+}
+
+// GetObjectByParentAndName finds a child element by name and its parent id (the lowest
+// id when several children have the same name)
+func (c *SQLiteCache) GetObjectByParentAndName(parent, name string) (*APIObject, error) {
+	Log.Tracef("Getting object %v in parent %v", name, parent)
+
+	query := "SELECT o.data FROM parents p JOIN objects o ON o.id = p.object_id WHERE p.parent_id = ? AND p.name = ? ORDER BY p.object_id LIMIT 1"
+	c.trace(query, parent, name)
+	var data []byte
+	err := c.db.QueryRow(query, parent, name).Scan(&data)
+	if sql.ErrNoRows == err {
+		c.lookups.count(ErrNotFound)
+		return nil, fmt.Errorf("Could not find object with name %v in parent %v: %w", name, parent, ErrNotFound)
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get object with name %v in parent %v from cache", name, parent)
+	}
+
+	var object APIObject
+	if err := json.Unmarshal(data, &object); nil != err {
+		return nil, err
+	}
+	c.lookups.count(nil)
+
+	Log.Tracef("Got object from cache %v", object)
+	return &object, nil
+}
+
+// DeleteObject deletes an object by id
+func (c *SQLiteCache) DeleteObject(id string) error {
+	err := c.transaction(func(tx *sql.Tx) error {
+		return sqliteDeleteObject(c, tx, id)
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not delete object %v", id)
+	}
+
+	return nil
+}
+
+// UpdateObject updates an object
+func (c *SQLiteCache) UpdateObject(object *APIObject) error {
+	err := c.transaction(func(tx *sql.Tx) error {
+		return sqliteUpdateObject(c, tx, object)
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not update/save object %v (%v)", object.ObjectID, object.Name)
+	}
+
+	return nil
+}
+
+// BatchUpdateObjects updates multiple objects in one transaction
+func (c *SQLiteCache) BatchUpdateObjects(objects []*APIObject) error {
+	err := c.transaction(func(tx *sql.Tx) error {
+		for _, object := range objects {
+			if err := sqliteUpdateObject(c, tx, object); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not update/save objects: %v", err)
+	}
+
+	return nil
+}
+
+// ApplyChanges deletes and updates the objects of one page of changes and stores the
+// page token to continue with in one transaction
+func (c *SQLiteCache) ApplyChanges(objects []*APIObject, deletedIDs []string, pageToken string) error {
+	err := c.transaction(func(tx *sql.Tx) error {
+		for _, id := range deletedIDs {
+			if err := sqliteDeleteObject(c, tx, id); nil != err {
+				return err
+			}
+		}
+		for _, object := range objects {
+			if err := sqliteUpdateObject(c, tx, object); nil != err {
+				return err
+			}
+		}
+
+		query := "INSERT OR REPLACE INTO page_token (id, token) VALUES (1, ?)"
+		c.trace(query, pageToken)
+		_, err := tx.Exec(query, pageToken)
+		return err
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not apply changes (%v updated, %v deleted): %v", len(objects), len(deletedIDs), err)
+	}
+
+	return nil
+}
+
+// StoreStartPageToken stores the page token for changes
+func (c *SQLiteCache) StoreStartPageToken(token string) error {
+	Log.Debugf("Storing page token %v in cache", token)
+
+	query := "INSERT OR REPLACE INTO page_token (id, token) VALUES (1, ?)"
+	c.trace(query, token)
+	if _, err := c.db.Exec(query, token); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store token %v", token)
+	}
+
+	return nil
+}
+
+// GetStartPageToken gets the start page token
+func (c *SQLiteCache) GetStartPageToken() (string, error) {
+	var pageToken string
+
+	Log.Debugf("Getting start page token from cache")
+	query := "SELECT token FROM page_token WHERE id = 1"
+	c.trace(query)
+	if err := c.db.QueryRow(query).Scan(&pageToken); nil != err && sql.ErrNoRows != err {
+		Log.Debugf("%v", err)
+	}
+	if pageToken == "" {
+		return "", fmt.Errorf("Could not get token from cache, token is empty")
+	}
+
+	Log.Tracef("Got start page token %v", pageToken)
+	return pageToken, nil
+}
+
+// StoreCrawlState stores the progress of warming the cache
+func (c *SQLiteCache) StoreCrawlState(state *CrawlState) error {
+	data, err := json.Marshal(state)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not marshal crawl state")
+	}
+
+	query := "INSERT OR REPLACE INTO crawl_state (id, data) VALUES (1, ?)"
+	c.trace(query, len(data))
+	if _, err := c.db.Exec(query, data); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store crawl state")
+	}
+
+	return nil
+}
+
+// LoadCrawlState loads the progress of warming the cache (nil if no walk has been started)
+func (c *SQLiteCache) LoadCrawlState() (*CrawlState, error) {
+	var data []byte
+	query := "SELECT data FROM crawl_state WHERE id = 1"
+	c.trace(query)
+	err := c.db.QueryRow(query).Scan(&data)
+	if sql.ErrNoRows == err {
+		return nil, nil
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not load crawl state")
+	}
+
+	state := &CrawlState{}
+	if err := json.Unmarshal(data, state); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not unmarshal crawl state")
+	}
+	return state, nil
+}
+
+// StoreSource stores the root folder and drive the cache is built for
+func (c *SQLiteCache) StoreSource(source *CacheSource) error {
+	data, err := json.Marshal(source)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not marshal cache source")
+	}
+
+	query := "INSERT OR REPLACE INTO source (id, data) VALUES (1, ?)"
+	c.trace(query, len(data))
+	if _, err := c.db.Exec(query, data); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store cache source")
+	}
+
+	return nil
+}
+
+// LoadSource loads the root folder and drive the cache is built for (nil if unknown)
+func (c *SQLiteCache) LoadSource() (*CacheSource, error) {
+	var data []byte
+	query := "SELECT data FROM source WHERE id = 1"
+	c.trace(query)
+	err := c.db.QueryRow(query).Scan(&data)
+	if sql.ErrNoRows == err {
+		return nil, nil
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not load cache source")
+	}
+
+	source := &CacheSource{}
+	if err := json.Unmarshal(data, source); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not unmarshal cache source")
+	}
+	return source, nil
+}
+
+// Stats gets the number and size of the cached objects and the lookup counters
+// (all objects are read, so this is too expensive to be called for every request)
+func (c *SQLiteCache) Stats() (*CacheStats, error) {
+	stats := &CacheStats{}
+
+	var pageCount, pageSize int64
+	if err := c.db.QueryRow("PRAGMA page_count").Scan(&pageCount); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get size of cache")
+	}
+	if err := c.db.QueryRow("PRAGMA page_size").Scan(&pageSize); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get size of cache")
+	}
+	stats.Bytes = pageCount * pageSize
+
+	err := c.ForEachObject(func(object *APIObject) error {
+		stats.addObject(object)
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	c.lookups.fill(stats)
+	return stats, nil
+}
+
+// ForEachObject calls fn for every cached object, objects that can't be read are skipped
+func (c *SQLiteCache) ForEachObject(fn func(object *APIObject) error) error {
+	query := "SELECT data FROM objects"
+	c.trace(query)
+	rows, err := c.db.Query(query)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not get objects from cache")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); nil != err {
+			Log.Debugf("%v", err)
+			continue
+		}
+		var object APIObject
+		if err := json.Unmarshal(data, &object); nil != err {
+			Log.Debugf("%v", err)
+			continue
+		}
+		if err := fn(&object); nil != err {
+			return err
+		}
+	}
+	if err := rows.Err(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not get objects from cache")
+	}
+	return nil
+}
+
+// sqliteMigrate drops all cached objects when the schema version changed,
+// so that the cache is rebuilt from the beginning
+func sqliteMigrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); nil != err {
+		return err
+	}
+	if sqliteSchemaVersion == version {
+		return nil
+	}
+
+	// a new cache file has no version and no tables yet
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables); nil != err {
+		return err
+	}
+	if 0 != version || 0 != tables {
+		Log.Infof("Cache schema changed (%v -> %v), rebuilding cache", version, sqliteSchemaVersion)
+	}
+	for _, table := range []string{"objects", "parents", "page_token", "crawl_state", "source"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); nil != err {
+			return err
+		}
+	}
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %v", sqliteSchemaVersion))
+	return err
+}
+
+// transaction runs the function in a transaction and commits it when no error occurred
+func (c *SQLiteCache) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := c.db.Begin()
+	if nil != err {
+		return err
+	}
+	if err := fn(tx); nil != err {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteQuerier is implemented by *sql.DB and *sql.Tx
+type sqliteQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func sqliteGetObject(c *SQLiteCache, q sqliteQuerier, id string) (*APIObject, error) {
+	query := "SELECT data FROM objects WHERE id = ?"
+	c.trace(query, id)
+	var data []byte
+	err := q.QueryRow(query, id).Scan(&data)
+	if sql.ErrNoRows == err {
+		return nil, fmt.Errorf("Could not find object %v in cache: %w", id, ErrNotFound)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	var object APIObject
+	err = json.Unmarshal(data, &object)
+	return &object, err
+}
+
+func sqliteDeleteObject(c *SQLiteCache, q sqliteQuerier, id string) error {
+	query := "DELETE FROM parents WHERE object_id = ?"
+	c.trace(query, id)
+	if _, err := q.Exec(query, id); nil != err {
+		return err
+	}
+
+	query = "DELETE FROM objects WHERE id = ?"
+	c.trace(query, id)
+	_, err := q.Exec(query, id)
+	return err
+}
+
+func sqliteUpdateObject(c *SQLiteCache, q sqliteQuerier, object *APIObject) error {
+	data, err := json.Marshal(object)
+	if nil != err {
+		return err
+	}
+
+	// Remove the old index entries, the parents or the name could have changed
+	query := "DELETE FROM parents WHERE object_id = ?"
+	c.trace(query, object.ObjectID)
+	if _, err := q.Exec(query, object.ObjectID); nil != err {
+		return err
+	}
+
+	query = "INSERT OR REPLACE INTO objects (id, data) VALUES (?, ?)"
+	c.trace(query, object.ObjectID)
+	if _, err := q.Exec(query, object.ObjectID, data); nil != err {
+		return err
+	}
+
+	// Store the object id by parent-name in the index
+	query = "INSERT OR REPLACE INTO parents (parent_id, name, object_id) VALUES (?, ?, ?)"
+	for _, parent := range indexParents(object) {
+		c.trace(query, parent, object.Name, object.ObjectID)
+		if _, err := q.Exec(query, parent, object.Name, object.ObjectID); nil != err {
+			return err
+		}
+	}
+	return nil
+}
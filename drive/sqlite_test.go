@@ -0,0 +1,194 @@
+package drive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteCache(t testing.TB) (*SQLiteCache, func()) {
+	dir, err := ioutil.TempDir("", "plexdrive-cache")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	cache, err := NewSQLiteCache(filepath.Join(dir, "cache.sqlite"), dir, nil, false)
+	if nil != err {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return cache, func() {
+		cache.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLiteParentIndex(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	if err := cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "1", Name: "file", Parents: []string{"a", "b"}},
+		{ObjectID: "2", Name: "shared"},
+	}); nil != err {
+		t.Fatal(err)
+	}
+
+	for _, parent := range []string{"a", "b"} {
+		objects, _ := cache.GetObjectsByParent(parent)
+		if 1 != len(objects) || "1" != objects[0].ObjectID {
+			t.Fatalf("Expected object 1 in parent %v got %v", parent, objects)
+		}
+	}
+	if object, err := cache.GetObjectByParentAndName(SharedFolderID, "shared"); nil != err || "2" != object.ObjectID {
+		t.Fatalf("Expected object 2 in shared folder got %v (%v)", object, err)
+	}
+
+	// rename and move the object to another parent
+	if err := cache.UpdateObject(&APIObject{ObjectID: "1", Name: "renamed", Parents: []string{"b"}}); nil != err {
+		t.Fatal(err)
+	}
+	if objects, _ := cache.GetObjectsByParent("a"); 0 != len(objects) {
+		t.Fatalf("Expected no objects in parent a got %v", objects)
+	}
+	if _, err := cache.GetObjectByParentAndName("b", "file"); nil == err {
+		t.Fatalf("Expected old name to be removed from the index")
+	}
+	if _, err := cache.GetObjectByParentAndName("b", "renamed"); nil != err {
+		t.Fatal(err)
+	}
+
+	if err := cache.DeleteObject("1"); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetObject("1"); nil == err {
+		t.Fatalf("Expected object 1 to be deleted")
+	}
+	if objects, _ := cache.GetObjectsByParent("b"); 0 != len(objects) {
+		t.Fatalf("Expected no objects in parent b got %v", objects)
+	}
+}
+
+func TestSQLitePageToken(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	if _, err := cache.GetStartPageToken(); nil == err {
+		t.Fatalf("Expected an error for an empty page token")
+	}
+	cache.StoreStartPageToken("1")
+	cache.StoreStartPageToken("2")
+	if token, err := cache.GetStartPageToken(); nil != err || "2" != token {
+		t.Fatalf("Expected page token 2 got %v (%v)", token, err)
+	}
+}
+
+// benchmarkGetObjectsByParent lists a folder with 50k files
+
+func benchmarkGetObjectsByParent(b *testing.B, cache Cache) {
+	objects := make([]*APIObject, 0, 50000)
+	for i := 0; i < 50000; i++ {
+		objects = append(objects, &APIObject{ObjectID: fmt.Sprintf("%v", i), Name: fmt.Sprintf("file %v", i), Parents: []string{"folder"}})
+	}
+	if err := cache.BatchUpdateObjects(objects); nil != err {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if children, _ := cache.GetObjectsByParent("folder"); 50000 != len(children) {
+			b.Fatalf("Expected 50000 children got %v", len(children))
+		}
+	}
+}
+
+func BenchmarkSQLiteGetObjectsByParent(b *testing.B) {
+	cache, cleanup := newTestSQLiteCache(b)
+	defer cleanup()
+	benchmarkGetObjectsByParent(b, cache)
+}
+
+func BenchmarkBoltGetObjectsByParent(b *testing.B) {
+	dir, err := ioutil.TempDir("", "plexdrive-cache")
+	if nil != err {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewBoltCache(filepath.Join(dir, "cache.bolt"), dir, nil, false)
+	if nil != err {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+	benchmarkGetObjectsByParent(b, cache)
+}
+
+func TestCacheStats(t *testing.T) {
+	sqliteCache, cleanupSQLite := newTestSQLiteCache(t)
+	defer cleanupSQLite()
+	boltCache, cleanupBolt := newTestCache(t)
+	defer cleanupBolt()
+
+	oldest := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, cache := range []Cache{sqliteCache, boltCache} {
+		cache.BatchUpdateObjects([]*APIObject{
+			{ObjectID: "1", Name: "old.mkv", Parents: []string{"root"}, CachedAt: oldest},
+			{ObjectID: "2", Name: "new.mkv", Parents: []string{"root"}, CachedAt: oldest.Add(time.Hour)},
+			{ObjectID: "3", Name: "unknown.mkv", Parents: []string{"root"}},
+		})
+		cache.GetObject("1")
+		cache.GetObjectByParentAndName("root", "new.mkv")
+		cache.GetObject("missing")
+
+		stats, err := cache.Stats()
+		if nil != err {
+			t.Fatal(err)
+		}
+		if 3 != stats.Objects || stats.Bytes <= 0 || !oldest.Equal(stats.OldestEntry) {
+			t.Fatalf("Expected 3 objects cached since %v got %v", oldest, stats)
+		}
+		if 2 != stats.Hits || 1 != stats.Misses || 2.0/3 != stats.HitRatio() {
+			t.Fatalf("Expected 2 hits and 1 miss got %v", stats)
+		}
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	sqliteCache, cleanupSQLite := newTestSQLiteCache(t)
+	defer cleanupSQLite()
+	boltCache, cleanupBolt := newTestCache(t)
+	defer cleanupBolt()
+
+	for _, cache := range []Cache{sqliteCache, boltCache} {
+		cache.BatchUpdateObjects([]*APIObject{
+			{ObjectID: "1", Name: "deleted.mkv", Parents: []string{"root"}},
+			{ObjectID: "2", Name: "old.mkv", Parents: []string{"root"}},
+		})
+
+		err := cache.ApplyChanges([]*APIObject{
+			{ObjectID: "2", Name: "renamed.mkv", Parents: []string{"root"}},
+			{ObjectID: "3", Name: "new.mkv", Parents: []string{"root"}},
+		}, []string{"1", "unknown"}, "42")
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		children, _ := cache.GetObjectsByParent("root")
+		if 2 != len(children) {
+			t.Fatalf("Expected the changed objects got %v", children)
+		}
+		if _, err := cache.GetObjectByParentAndName("root", "deleted.mkv"); nil == err {
+			t.Fatalf("Expected the deleted object to be removed")
+		}
+		if _, err := cache.GetObjectByParentAndName("root", "renamed.mkv"); nil != err {
+			t.Fatalf("Expected the renamed object got %v", err)
+		}
+		if token, _ := cache.GetStartPageToken(); "42" != token {
+			t.Fatalf("Expected page token 42 got %v", token)
+		}
+	}
+}
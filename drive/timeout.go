@@ -0,0 +1,64 @@
+package drive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// idleTimeoutTransport aborts responses when no data has been received for the timeout,
+// long downloads are not limited as long as the data keeps coming
+type idleTimeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+// RoundTrip sends the request with a context that is canceled when the response is idle
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	res, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if nil != err {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+
+	res.Body = &idleTimeoutBody{
+		body:    res.Body,
+		parent:  req.Context(),
+		ctx:     ctx,
+		cancel:  cancel,
+		timer:   timer,
+		timeout: t.timeout,
+	}
+	return res, nil
+}
+
+// idleTimeoutBody restarts the idle timer with every read
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	parent  context.Context
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if nil != err && nil != b.ctx.Err() && nil == b.parent.Err() {
+		return n, fmt.Errorf("No data received for %v: %w", b.timeout, err)
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
@@ -0,0 +1,60 @@
+package drive
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeoutAbortsStalledDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("data"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &idleTimeoutTransport{transport: http.DefaultTransport, timeout: 50 * time.Millisecond}}
+	res, err := client.Get(server.URL)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	bytes, err := ioutil.ReadAll(res.Body)
+	if nil == err || !strings.Contains(err.Error(), "No data received") {
+		t.Fatalf("Expected the stalled download to be aborted got %v", err)
+	}
+	if "data" != string(bytes) {
+		t.Fatalf("Expected the received data got %v", string(bytes))
+	}
+}
+
+func TestIdleTimeoutKeepsActiveDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("da"))
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &idleTimeoutTransport{transport: http.DefaultTransport, timeout: 50 * time.Millisecond}}
+	res, err := client.Get(server.URL)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if bytes, err := ioutil.ReadAll(res.Body); nil != err || 8 != len(bytes) {
+		t.Fatalf("Expected the whole download got %v bytes (%v)", len(bytes), err)
+	}
+}
@@ -0,0 +1,201 @@
+package drive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/oauth2"
+	gdrive "google.golang.org/api/drive/v3"
+)
+
+// tokenFile stores the OAuth token in the configuration directory
+// (encrypted when a token key is given), it is shared by all cache backends
+type tokenFile struct {
+	tokenPath string
+	tokenKey  []byte
+}
+
+// storedToken is the content of the token file, the granted scope is stored
+// as well to detect tokens that don't match the requested scopes
+type storedToken struct {
+	*oauth2.Token
+	Scope string `json:"scope,omitempty"`
+}
+
+func newTokenFile(configPath string, tokenKey []byte) *tokenFile {
+	return &tokenFile{
+		tokenPath: filepath.Join(configPath, "token.json"),
+		tokenKey:  tokenKey,
+	}
+}
+
+// LoadToken loads a token from cache
+func (c *tokenFile) LoadToken() (*oauth2.Token, error) {
+	Log.Debugf("Loading token from cache")
+
+	tokenFile, err := ioutil.ReadFile(c.tokenPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read token file in %v", c.tokenPath)
+	}
+
+	stored := storedToken{Token: &oauth2.Token{}}
+	migrate := false
+	if len(c.tokenKey) > 0 {
+		decrypted, legacy, err := decryptToken(c.tokenKey, tokenFile)
+		if nil == err {
+			json.Unmarshal(decrypted, &stored)
+			if legacy {
+				Log.Infof("Encrypting token file %v with a derived key", c.tokenPath)
+				migrate = true
+			}
+		} else if nil == json.Unmarshal(tokenFile, &stored) {
+			// migrate an existing plaintext token file
+			Log.Infof("Encrypting existing token file %v", c.tokenPath)
+			migrate = true
+		} else {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not decrypt token file in %v", c.tokenPath)
+		}
+	} else {
+		json.Unmarshal(tokenFile, &stored)
+	}
+
+	token := stored.Token
+	if "" != stored.Scope {
+		token = token.WithExtra(map[string]interface{}{"scope": stored.Scope})
+	}
+
+	if migrate {
+		if err := c.StoreToken(token); nil != err {
+			Log.Warningf("%v", err)
+		}
+	}
+
+	Log.Tracef("Got token from cache %v", token)
+
+	return token, nil
+}
+
+// StoreToken stores a token in the cache or updates the existing token element
+func (c *tokenFile) StoreToken(token *oauth2.Token) error {
+	Log.Debugf("Storing token to cache")
+
+	tokenJSON, err := json.Marshal(storedToken{Token: token, Scope: tokenScope(token)})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not generate token.json content")
+	}
+
+	if len(c.tokenKey) > 0 {
+		tokenJSON, err = encryptToken(c.tokenKey, tokenJSON)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return fmt.Errorf("Could not encrypt token.json content")
+		}
+	}
+
+	if err := writeTokenFile(c.tokenPath, tokenJSON); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not generate token.json file")
+	}
+
+	return nil
+}
+
+// writeTokenFile writes the content to a temporary file that only the user can read and
+// renames it over the token file, so that an existing token file with wider permissions
+// is replaced and an interrupted write never leaves a truncated token behind
+func writeTokenFile(tokenPath string, content []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(tokenPath), filepath.Base(tokenPath)+".*.tmp")
+	if nil != err {
+		return err
+	}
+	if err := file.Chmod(0600); nil != err {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if _, err := file.Write(content); nil != err {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Sync(); nil != err {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); nil != err {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), tokenPath); nil != err {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// storingTokenSource stores every refreshed token in the cache,
+// so that refreshed (and rotated) tokens survive restarts
+type storingTokenSource struct {
+	source oauth2.TokenSource
+	cache  Cache
+	token  *oauth2.Token
+	lock   sync.Mutex
+}
+
+// Token gets the token from the underlying source and stores it when it changed
+func (s *storingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if nil != err {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if nil == s.token || token.AccessToken != s.token.AccessToken || token.RefreshToken != s.token.RefreshToken {
+		Log.Debugf("Token has been refreshed")
+		if "" == tokenScope(token) && nil != s.token && "" != tokenScope(s.token) {
+			// refresh responses don't always contain the scope, keep the granted one
+			token = token.WithExtra(map[string]interface{}{"scope": tokenScope(s.token)})
+		}
+		s.token = token
+		if err := s.cache.StoreToken(token); nil != err {
+			Log.Warningf("%v", err)
+		}
+	}
+
+	return token, nil
+}
+
+// tokenScope gets the scopes granted for the token (separated by spaces)
+func tokenScope(token *oauth2.Token) string {
+	if scope, ok := token.Extra("scope").(string); ok {
+		return scope
+	}
+	return ""
+}
+
+// hasScope checks if the token was granted exactly the scope (a full access token
+// is not reused in read only mode), tokens stored without a scope have been created
+// with the full drive scope
+func hasScope(token *oauth2.Token, scope string) bool {
+	granted := tokenScope(token)
+	if "" == granted {
+		granted = gdrive.DriveScope
+	}
+	for _, s := range strings.Fields(granted) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
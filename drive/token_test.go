@@ -0,0 +1,91 @@
+package drive
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/oauth2"
+	gdrive "google.golang.org/api/drive/v3"
+)
+
+func TestTokenScopeIsStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-token")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, key := range [][]byte{nil, []byte("secret")} {
+		tokens := newTokenFile(dir, key)
+		token := (&oauth2.Token{AccessToken: "a", RefreshToken: "r"}).WithExtra(map[string]interface{}{"scope": gdrive.DriveReadonlyScope})
+		if err := tokens.StoreToken(token); nil != err {
+			t.Fatal(err)
+		}
+
+		loaded, err := tokens.LoadToken()
+		if nil != err {
+			t.Fatal(err)
+		}
+		if "r" != loaded.RefreshToken {
+			t.Fatalf("Expected refresh token r got %v", loaded.RefreshToken)
+		}
+		if !hasScope(loaded, gdrive.DriveReadonlyScope) || hasScope(loaded, gdrive.DriveScope) {
+			t.Fatalf("Expected only the read only scope got %v", tokenScope(loaded))
+		}
+	}
+}
+
+func TestTokenWithoutScopeHasFullAccess(t *testing.T) {
+	token := &oauth2.Token{AccessToken: "a"}
+	if !hasScope(token, gdrive.DriveScope) || hasScope(token, gdrive.DriveReadonlyScope) {
+		t.Fatalf("Expected a token without scope to have full access only")
+	}
+}
+
+func TestTokenFileIsOnlyReadableByTheUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-token")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokens := newTokenFile(dir, nil)
+	if err := ioutil.WriteFile(tokens.tokenPath, []byte("{}"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	if err := tokens.StoreToken(&oauth2.Token{AccessToken: "a"}); nil != err {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(tokens.tokenPath); nil != err || 0600 != info.Mode().Perm() {
+		t.Fatalf("Expected the token file to be only readable by the user got %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestLegacyEncryptedTokenIsMigrated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-token")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a token encrypted with the SHA-256 hash of the key
+	key := []byte("secret")
+	hash := sha256.Sum256(key)
+	gcm, err := newTokenCipher(hash[:])
+	if nil != err {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	tokens := newTokenFile(dir, key)
+	ioutil.WriteFile(tokens.tokenPath, gcm.Seal(nonce, nonce, []byte(`{"refresh_token": "r"}`), nil), 0600)
+
+	if token, err := tokens.LoadToken(); nil != err || "r" != token.RefreshToken {
+		t.Fatalf("Expected the legacy token to be loaded got %v (%v)", token, err)
+	}
+	content, _ := ioutil.ReadFile(tokens.tokenPath)
+	if _, legacy, err := decryptToken(key, content); nil != err || legacy {
+		t.Fatalf("Expected the token to be encrypted with a derived key (%v)", err)
+	}
+}
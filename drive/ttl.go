@@ -0,0 +1,96 @@
+package drive
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// CacheTTL is the time after which a cached object is fetched again from the API on access
+// (0 = disabled, objects are only updated by the changes), the stale object is served meanwhile
+var CacheTTL time.Duration
+
+// MaxCacheTTL is the upper limit of the TTL, the TTL of an object is doubled every time
+// it is fetched again without being modified
+var MaxCacheTTL = 24 * time.Hour
+
+// maxRevalidations is the number of stale objects that are fetched at the same time,
+// further stale objects are fetched on a later access
+const maxRevalidations = 8
+
+// objectTTL is the current TTL of an object, failed fetches are retried after retryAt
+type objectTTL struct {
+	ttl     time.Duration
+	retryAt time.Time
+}
+
+// checkStale fetches the object in the background when it is older than its TTL
+func (d *Client) checkStale(object *APIObject) {
+	if CacheTTL <= 0 || SharedFolderID == object.ObjectID || d.IsDegraded() {
+		return
+	}
+
+	d.ttlLock.Lock()
+	defer d.ttlLock.Unlock()
+	if nil == d.ttls {
+		d.ttls = make(map[string]objectTTL)
+		d.revalidating = make(map[string]bool)
+	}
+
+	current, exists := d.ttls[object.ObjectID]
+	if !exists {
+		current = objectTTL{ttl: CacheTTL}
+	}
+	if time.Since(object.CachedAt) < current.ttl || time.Now().Before(current.retryAt) {
+		return
+	}
+	if d.revalidating[object.ObjectID] || len(d.revalidating) >= maxRevalidations {
+		return
+	}
+
+	// the object is changed while resolving shortcuts, keep the cached state
+	stale := *object
+	d.revalidating[object.ObjectID] = true
+	go d.revalidate(&stale, current.ttl)
+}
+
+// checkStaleID checks the cached object with the id, see checkStale
+func (d *Client) checkStaleID(id string) {
+	if CacheTTL <= 0 {
+		return
+	}
+	if object, err := d.cache.GetObject(id); nil == err {
+		d.checkStale(object)
+	}
+}
+
+// revalidate fetches the stale object (and the children of directories) and doubles
+// its TTL when it has not been modified, the TTL is reset otherwise
+func (d *Client) revalidate(object *APIObject, ttl time.Duration) {
+	Log.Debugf("Revalidating stale object %v (%v)", object.ObjectID, object.Name)
+
+	_, err := d.refreshObject(object)
+	fresh, _ := d.cache.GetObject(object.ObjectID)
+
+	d.ttlLock.Lock()
+	defer d.ttlLock.Unlock()
+	delete(d.revalidating, object.ObjectID)
+
+	switch {
+	case errors.Is(err, ErrNotFound):
+		delete(d.ttls, object.ObjectID)
+	case nil != err:
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not revalidate object %v (%v)", object.ObjectID, object.Name)
+		d.ttls[object.ObjectID] = objectTTL{ttl: ttl, retryAt: time.Now().Add(CacheTTL)}
+	case nil != fresh && fresh.LastModified.Equal(object.LastModified) && fresh.Name == object.Name:
+		ttl *= 2
+		if ttl > MaxCacheTTL {
+			ttl = MaxCacheTTL
+		}
+		d.ttls[object.ObjectID] = objectTTL{ttl: ttl}
+	default:
+		d.ttls[object.ObjectID] = objectTTL{ttl: CacheTTL}
+	}
+}
@@ -0,0 +1,58 @@
+package drive
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStaleObjectIsRevalidated(t *testing.T) {
+	requests := 0
+	handler := func(r *http.Request) (int, string) {
+		requests++
+		body := `{"id": "1", "name": "movie.mkv", "size": "42", "modifiedTime": "2020-01-01T00:00:00Z", "capabilities": {}}`
+		return 200, body
+	}
+
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.UpdateObject(&APIObject{ObjectID: "1", Name: "movie.mkv", LastModified: modified, CachedAt: time.Now().Add(-2 * time.Hour)})
+
+	cacheTTL := CacheTTL
+	CacheTTL = time.Hour
+	defer func() { CacheTTL = cacheTTL }()
+
+	client := newTestClient(cache, handler)
+
+	// the stale object is served while it is fetched in the background
+	if object, err := client.GetObject("1"); nil != err || 0 != object.Size {
+		t.Fatalf("Expected the stale object got %v (%v)", object, err)
+	}
+	waitForRevalidations(client)
+	if object, _ := cache.GetObject("1"); 42 != object.Size || time.Since(object.CachedAt) > time.Minute {
+		t.Fatalf("Expected the revalidated object to be cached got %v", object)
+	}
+	if 2*time.Hour != client.ttls["1"].ttl {
+		t.Fatalf("Expected the TTL of an unmodified object to be doubled got %v", client.ttls["1"].ttl)
+	}
+
+	// fresh objects are not fetched again
+	client.GetObject("1")
+	waitForRevalidations(client)
+	if 1 != requests {
+		t.Fatalf("Expected one request got %v", requests)
+	}
+}
+
+func waitForRevalidations(client *Client) {
+	for i := 0; i < 100; i++ {
+		client.ttlLock.Lock()
+		running := len(client.revalidating)
+		client.ttlLock.Unlock()
+		if 0 == running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,374 @@
+package drive
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	gdrive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// WarmCacheWorkers is the number of folders that are listed concurrently while warming the cache
+var WarmCacheWorkers = 4
+
+// WarmCacheFoldersOnly only lists and stores the folders (and shortcuts) while warming the cache,
+// the files are stored by the changes
+var WarmCacheFoldersOnly bool
+
+// folderMimeType is the mime type of Google Drive folders
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// crawlSaveInterval is the time between two stores of the progress of warming the cache
+const crawlSaveInterval = 30 * time.Second
+
+// crawlRetries is the number of times a folder that could not be listed is listed again
+// before it is left for the next start
+const crawlRetries = 3
+
+// WarmCache walks the whole tree below the root once and stores all objects in the cache,
+// so that the first directory listings don't have to wait for the changes to be processed
+// (maxDepth limits the depth of the walk, 0 = unlimited). The progress is stored in the
+// cache, an interrupted walk is resumed and a completed walk isn't repeated.
+func (d *Client) WarmCache(maxDepth int) {
+	root, err := d.getRootObject()
+	if nil != err {
+		Log.Warningf("Could not warm cache: %v", err)
+		return
+	}
+
+	state, err := d.cache.LoadCrawlState()
+	if nil != err {
+		Log.Warningf("%v", err)
+	}
+	if nil != state && (state.Root != root.ObjectID || state.MaxDepth != maxDepth || state.FoldersOnly != WarmCacheFoldersOnly) {
+		Log.Debugf("Root, depth or mode changed since the cache has been warmed, warming it again")
+		state = nil
+	}
+	if nil != state && state.Complete {
+		Log.Infof("Cache has already been warmed")
+		return
+	}
+
+	if nil != state {
+		Log.Infof("Warming cache resumed with %v pending folders...", len(state.Pending))
+	} else {
+		Log.Infof("Warming cache started...")
+	}
+	d.warmLock.Lock()
+	d.warmChanged = make(map[string]time.Time)
+	d.warmLock.Unlock()
+	defer func() {
+		d.warmLock.Lock()
+		d.warmChanged = nil
+		d.warmLock.Unlock()
+	}()
+
+	c := newCrawler(d, root.ObjectID, maxDepth)
+	count, complete := c.crawl(state)
+	if c.interrupted {
+		Log.Infof("Warming cache interrupted, stored %v objects, it is resumed with the next start", count)
+		return
+	}
+	if !complete {
+		Log.Warningf("Warming cache stopped, stored %v objects, %v folders could not be listed and are listed again with the next start",
+			count, len(c.failed))
+		return
+	}
+	Log.Infof("Warming cache finished, stored %v objects", count)
+}
+
+// crawler lists the folders of a tree with a fixed number of workers, every folder
+// (or shortcut target) is only listed once so that shortcut loops end the walk
+type crawler struct {
+	client   *Client
+	root     string
+	maxDepth int
+	lock     sync.Mutex
+	wakeup   *sync.Cond
+	pending  []CrawlFolder
+	listing  map[string]CrawlFolder
+	visited  map[string]bool
+	// retries counts the failed listings per folder, failed are the folders that
+	// could not be listed after all retries
+	retries map[string]int
+	failed  []CrawlFolder
+	active  int
+	count   int
+	saved   time.Time
+	// interrupted is set when the client has been closed during the walk
+	interrupted bool
+}
+
+func newCrawler(client *Client, root string, maxDepth int) *crawler {
+	c := &crawler{
+		client:   client,
+		root:     root,
+		maxDepth: maxDepth,
+		listing:  make(map[string]CrawlFolder),
+		visited:  make(map[string]bool),
+		retries:  make(map[string]int),
+		saved:    time.Now(),
+	}
+	c.wakeup = sync.NewCond(&c.lock)
+	return c
+}
+
+// crawl lists all folders below the root (or the pending folders of the stored state)
+// and returns the number of stored objects and whether the walk has been completed, it
+// is not completed when it has been interrupted or folders could not be listed
+func (c *crawler) crawl(state *CrawlState) (int, bool) {
+	if nil != state {
+		for _, id := range state.Visited {
+			c.visited[id] = true
+		}
+		c.pending = append(c.pending, state.Pending...)
+	} else {
+		c.visited[c.root] = true
+		c.pending = append(c.pending, CrawlFolder{ID: c.root, Depth: 1})
+	}
+
+	workers := WarmCacheWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.work()
+		}()
+	}
+	wg.Wait()
+
+	complete := !c.interrupted && 0 == len(c.failed)
+	if !c.interrupted {
+		c.save(complete)
+	}
+	return c.count, complete
+}
+
+// work lists pending folders until no folder is pending and no other worker
+// can add new ones
+func (c *crawler) work() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		for (0 == len(c.pending) || c.interrupted) && c.active > 0 {
+			c.wakeup.Wait()
+		}
+		if 0 == len(c.pending) || c.interrupted {
+			return
+		}
+
+		// the last added folder is listed first, this keeps the list of pending
+		// folders short for wide trees
+		folder := c.pending[len(c.pending)-1]
+		c.pending = c.pending[:len(c.pending)-1]
+		c.listing[folder.ID] = folder
+		c.active++
+		c.lock.Unlock()
+
+		objects, err := c.list(folder)
+
+		c.lock.Lock()
+		c.active--
+		c.count += len(objects)
+		delete(c.listing, folder.ID)
+		if nil != err {
+			// the folder is listed again after the other pending folders, the children
+			// of a partial listing are walked already
+			c.retries[folder.ID]++
+			if c.retries[folder.ID] <= crawlRetries {
+				c.pending = append([]CrawlFolder{folder}, c.pending...)
+			} else {
+				Log.Warningf("Could not list folder %v after %v retries, it is listed again with the next start", folder.ID, crawlRetries)
+				c.failed = append(c.failed, folder)
+			}
+		}
+		if 0 == c.maxDepth || folder.Depth < c.maxDepth {
+			for _, object := range objects {
+				// excluded folders are crawled as well so that their content is cached
+				// once the exclude is removed
+				if !object.IsDir {
+					continue
+				}
+				id := object.ObjectID
+				if "" != object.ShortcutTargetID {
+					id = object.ShortcutTargetID
+				}
+				if !c.visited[id] {
+					c.visited[id] = true
+					c.pending = append(c.pending, CrawlFolder{ID: id, Depth: folder.Depth + 1})
+				}
+			}
+		}
+		if c.client.isClosed() {
+			// keep the progress, the walk is resumed after the restart
+			c.interrupted = true
+			c.save(false)
+		} else if time.Since(c.saved) >= crawlSaveInterval {
+			c.save(false)
+		}
+		c.wakeup.Broadcast()
+	}
+}
+
+// save stores the progress of the walk in the cache, the folders that are being listed or
+// could not be listed are stored as pending (the lock has to be held)
+func (c *crawler) save(complete bool) {
+	state := &CrawlState{
+		Root:        c.root,
+		MaxDepth:    c.maxDepth,
+		FoldersOnly: WarmCacheFoldersOnly,
+		Pending:     make([]CrawlFolder, 0, len(c.pending)+len(c.listing)+len(c.failed)),
+		Visited:     make([]string, 0, len(c.visited)),
+		Complete:    complete,
+	}
+	state.Pending = append(state.Pending, c.pending...)
+	state.Pending = append(state.Pending, c.failed...)
+	for _, folder := range c.listing {
+		state.Pending = append(state.Pending, folder)
+	}
+	for id := range c.visited {
+		state.Visited = append(state.Visited, id)
+	}
+
+	if err := c.client.cache.StoreCrawlState(state); nil != err {
+		Log.Warningf("%v", err)
+	}
+	c.saved = time.Now()
+}
+
+// list lists the children of the folder and stores them in the cache, when the listing
+// fails the children listed so far are stored and returned with the error
+func (c *crawler) list(folder CrawlFolder) ([]*APIObject, error) {
+	list := c.client.listChildren
+	if WarmCacheFoldersOnly {
+		list = c.client.listChildFolders
+	}
+	started := time.Now()
+	objects, listErr := list(folder.ID)
+	if nil != listErr {
+		Log.Warningf("%v", listErr)
+		if 0 == len(objects) {
+			return nil, listErr
+		}
+	}
+
+	if err := c.client.storeListing(objects, started); nil != err {
+		Log.Warningf("%v", err)
+		return nil, err
+	}
+	return objects, listErr
+}
+
+// applyChanges stores a page of changes, the changed and deleted ids are remembered while the
+// cache is warmed so that older listings don't overwrite them
+func (d *Client) applyChanges(objects []*APIObject, deletedIDs []string, pageToken string) error {
+	d.warmLock.Lock()
+	defer d.warmLock.Unlock()
+	if err := d.cache.ApplyChanges(objects, deletedIDs, pageToken); nil != err {
+		return err
+	}
+	if nil != d.warmChanged {
+		now := time.Now()
+		for _, object := range objects {
+			d.warmChanged[object.ObjectID] = now
+		}
+		for _, id := range deletedIDs {
+			d.warmChanged[id] = now
+		}
+	}
+	return nil
+}
+
+// storeListing stores the objects of a listing that has been started at the given time, objects
+// that have been changed or deleted by the changes since then are skipped (the listing is stale)
+func (d *Client) storeListing(objects []*APIObject, started time.Time) error {
+	d.warmLock.Lock()
+	defer d.warmLock.Unlock()
+	fresh := make([]*APIObject, 0, len(objects))
+	for _, object := range objects {
+		if changed, ok := d.warmChanged[object.ObjectID]; ok && !changed.Before(started) {
+			Log.Tracef("Skipping object %v of a stale listing", object.ObjectID)
+			continue
+		}
+		fresh = append(fresh, object)
+	}
+	return d.cache.BatchUpdateObjects(fresh)
+}
+
+// listChildren lists all (not trashed) children of the parent from the API, when a page
+// fails (after all retries) the children listed so far are returned with ErrIncompleteListing
+func (d *Client) listChildren(parent string) ([]*APIObject, error) {
+	return d.listFiles(fmt.Sprintf("'%v' in parents and trashed = false", parent), fmt.Sprintf("children of %v", parent))
+}
+
+// listChildFolders lists the (not trashed) child folders and shortcuts of the parent from the API,
+// shortcuts can't be filtered by their target type in the query
+func (d *Client) listChildFolders(parent string) ([]*APIObject, error) {
+	return d.listFiles(fmt.Sprintf("'%v' in parents and trashed = false and (mimeType = '%v' or mimeType = '%v')",
+		parent, folderMimeType, shortcutMimeType), fmt.Sprintf("child folders of %v", parent))
+}
+
+// listFiles lists all files matching the query from the API (following all pages), when a page
+// fails (after all retries) the files listed so far are returned with ErrIncompleteListing
+func (d *Client) listFiles(q, description string) ([]*APIObject, error) {
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	objects := make([]*APIObject, 0)
+	pageToken := ""
+	for {
+		query := client.Files.
+			List().
+			Q(q).
+			Fields(googleapi.Field(fmt.Sprintf("nextPageToken, files(%v)", Fields))).
+			PageSize(PageSize).
+			PageToken(pageToken).
+			SupportsAllDrives(true).
+			IncludeItemsFromAllDrives(true)
+
+		if "" != d.driveID {
+			query = query.Corpora("drive").DriveId(d.driveID)
+		}
+		if "" != Spaces {
+			query = query.Spaces(Spaces)
+		}
+
+		var results *gdrive.FileList
+		err := doWithRetry(fmt.Sprintf("list %v", description), func() error {
+			var err error
+			results, err = query.Do()
+			return err
+		})
+		if nil != err {
+			Log.Debugf("%v", err)
+			return objects, fmt.Errorf("Could not list all %v from API (got %v): %w", description, len(objects), ErrIncompleteListing)
+		}
+
+		for _, file := range results.Files {
+			object, err := d.mapFileToObject(file)
+			if nil != err {
+				Log.Debugf("%v", err)
+				Log.Warningf("Could not map Google Drive file %v (%v) to object", file.Id, file.Name)
+				continue
+			}
+			d.keepExportSize(object)
+			objects = append(objects, object)
+		}
+
+		if "" == results.NextPageToken {
+			break
+		}
+		pageToken = results.NextPageToken
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,174 @@
+package drive
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWarmCacheWithShortcutLoop(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	children := map[string]string{
+		"root-id": `{"id": "folder", "name": "Movies", "mimeType": "application/vnd.google-apps.folder", "parents": ["root-id"], "capabilities": {}},
+			{"id": "file", "name": "movie.mkv", "mimeType": "video/x-matroska", "parents": ["root-id"], "capabilities": {}}`,
+		"folder": `{"id": "loop", "name": "Back to root", "mimeType": "application/vnd.google-apps.shortcut", "parents": ["folder"], "capabilities": {},
+			"shortcutDetails": {"targetId": "root-id", "targetMimeType": "application/vnd.google-apps.folder"}}`,
+	}
+	var lock sync.Mutex
+	listed := make(map[string]int)
+	handler := func(r *http.Request) (int, string) {
+		parent := strings.Split(r.URL.Query().Get("q"), "'")[1]
+		lock.Lock()
+		listed[parent]++
+		lock.Unlock()
+		return 200, fmt.Sprintf(`{"files": [%v]}`, children[parent])
+	}
+	client := newTestClient(cache, handler)
+
+	client.WarmCache(0)
+
+	if 2 != len(listed) || 1 != listed["root-id"] || 1 != listed["folder"] {
+		t.Fatalf("Expected every folder to be listed once got %v", listed)
+	}
+	for _, id := range []string{"folder", "file", "loop"} {
+		if _, err := cache.GetObject(id); nil != err {
+			t.Fatalf("Expected object %v to be stored in the cache", id)
+		}
+	}
+}
+
+func TestWarmCacheResumesInterruptedWalk(t *testing.T) {
+	sqliteCache, cleanupSQLite := newTestSQLiteCache(t)
+	defer cleanupSQLite()
+	boltCache, cleanupBolt := newTestCache(t)
+	defer cleanupBolt()
+
+	for _, cache := range []Cache{sqliteCache, boltCache} {
+		var lock sync.Mutex
+		listed := make(map[string]int)
+		client := newTestClient(cache, func(r *http.Request) (int, string) {
+			parent := strings.Split(r.URL.Query().Get("q"), "'")[1]
+			lock.Lock()
+			listed[parent]++
+			lock.Unlock()
+			return 200, `{"files": []}`
+		})
+
+		// the root has been listed before the restart, one folder is still pending
+		if err := cache.StoreCrawlState(&CrawlState{
+			Root:    "root-id",
+			Pending: []CrawlFolder{{ID: "folder", Depth: 2}},
+			Visited: []string{"root-id", "folder"},
+		}); nil != err {
+			t.Fatal(err)
+		}
+
+		client.WarmCache(0)
+		if 1 != len(listed) || 1 != listed["folder"] {
+			t.Fatalf("Expected only the pending folder to be listed got %v", listed)
+		}
+		state, err := cache.LoadCrawlState()
+		if nil != err || nil == state || !state.Complete || 0 != len(state.Pending) {
+			t.Fatalf("Expected the walk to be complete got %v (%v)", state, err)
+		}
+
+		client.WarmCache(0)
+		if 1 != len(listed) || 1 != listed["folder"] {
+			t.Fatalf("Expected a completed walk not to be repeated got %v", listed)
+		}
+	}
+}
+
+func TestWarmCacheFoldersOnly(t *testing.T) {
+	WarmCacheFoldersOnly = true
+	defer func() { WarmCacheFoldersOnly = false }()
+
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	var queries []string
+	handler := func(r *http.Request) (int, string) {
+		queries = append(queries, r.URL.Query().Get("q"))
+		return 200, `{"files": []}`
+	}
+	client := newTestClient(cache, handler)
+
+	client.WarmCache(0)
+
+	if 1 != len(queries) || !strings.Contains(queries[0], "mimeType = 'application/vnd.google-apps.folder'") {
+		t.Fatalf("Expected only the folders of the root to be listed got %v", queries)
+	}
+	if state, err := cache.LoadCrawlState(); nil != err || nil == state || !state.FoldersOnly {
+		t.Fatalf("Expected the folders only walk to be stored got %v (%v)", state, err)
+	}
+}
+
+func TestWarmCacheRetriesFailedFolders(t *testing.T) {
+	maxAttempts := MaxAttempts
+	MaxAttempts = 1
+	defer func() { MaxAttempts = maxAttempts }()
+
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	children := map[string]string{
+		"root-id": `{"id": "flaky", "name": "Movies", "mimeType": "application/vnd.google-apps.folder", "parents": ["root-id"], "capabilities": {}},
+			{"id": "broken", "name": "Shows", "mimeType": "application/vnd.google-apps.folder", "parents": ["root-id"], "capabilities": {}}`,
+		"flaky": `{"id": "movie", "name": "movie.mkv", "mimeType": "video/x-matroska", "parents": ["flaky"], "capabilities": {}}`,
+	}
+	var lock sync.Mutex
+	listed := make(map[string]int)
+	client := newTestClient(cache, func(r *http.Request) (int, string) {
+		parent := strings.Split(r.URL.Query().Get("q"), "'")[1]
+		lock.Lock()
+		defer lock.Unlock()
+		listed[parent]++
+		if "broken" == parent || ("flaky" == parent && 1 == listed[parent]) {
+			return 500, `{"error": {"code": 500, "message": "backend error"}}`
+		}
+		return 200, fmt.Sprintf(`{"files": [%v]}`, children[parent])
+	})
+
+	client.WarmCache(0)
+
+	if 2 != listed["flaky"] || 1+crawlRetries != listed["broken"] {
+		t.Fatalf("Expected the failed folders to be listed again got %v", listed)
+	}
+	if _, err := cache.GetObject("movie"); nil != err {
+		t.Fatalf("Expected the content of the flaky folder to be stored")
+	}
+	state, err := cache.LoadCrawlState()
+	if nil != err || nil == state || state.Complete || 1 != len(state.Pending) || "broken" != state.Pending[0].ID {
+		t.Fatalf("Expected the walk to be incomplete with the broken folder pending got %v (%v)", state, err)
+	}
+}
+
+func TestWarmCacheSkipsObjectsChangedDuringListing(t *testing.T) {
+	cache, cleanup := newTestSQLiteCache(t)
+	defer cleanup()
+
+	var client *Client
+	client = newTestClient(cache, func(r *http.Request) (int, string) {
+		// the changes delete the file and rename the folder while the root is listed
+		if err := client.applyChanges([]*APIObject{{ObjectID: "folder", Name: "Renamed", IsDir: true, Parents: []string{"root-id"}}},
+			[]string{"file"}, "2"); nil != err {
+			t.Error(err)
+		}
+		return 200, `{"files": [
+			{"id": "folder", "name": "Movies", "mimeType": "application/vnd.google-apps.folder", "parents": ["root-id"], "capabilities": {}},
+			{"id": "file", "name": "movie.mkv", "mimeType": "video/x-matroska", "parents": ["root-id"], "capabilities": {}}]}`
+	})
+
+	client.WarmCache(1)
+
+	if _, err := cache.GetObject("file"); nil == err {
+		t.Fatalf("Expected the deleted file not to be stored again")
+	}
+	if folder, err := cache.GetObject("folder"); nil != err || "Renamed" != folder.Name {
+		t.Fatalf("Expected the renamed folder to be kept got %v (%v)", folder, err)
+	}
+}
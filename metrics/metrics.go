@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"net/http"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// APIRequests counts the requests sent to Google Drive (by type metadata / download)
+	APIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "plexdrive_api_requests_total",
+		Help: "The number of requests sent to the Google Drive API",
+	}, []string{"type"})
+
+	// ChunkCacheHits counts the chunks served from the cache (by tier memory / disk)
+	ChunkCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "plexdrive_chunk_cache_hits_total",
+		Help: "The number of chunks served from the chunk cache",
+	}, []string{"tier"})
+
+	// ChunkCacheMisses counts the chunks that had to be downloaded
+	ChunkCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "plexdrive_chunk_cache_misses_total",
+		Help: "The number of chunks that were not found in the chunk cache",
+	})
+
+	// CacheLookups counts the object lookups in the metadata cache (by result hit / miss)
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "plexdrive_cache_lookups_total",
+		Help: "The number of object lookups in the metadata cache",
+	}, []string{"result"})
+
+	// CacheObjects is the number of objects in the metadata cache (updated with every scrape)
+	CacheObjects = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "plexdrive_cache_objects",
+		Help: "The number of objects in the metadata cache",
+	})
+
+	// CacheBytes is the size of the metadata cache (updated with every scrape)
+	CacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "plexdrive_cache_bytes",
+		Help: "The size of the metadata cache in bytes",
+	})
+
+	// QuotaLimit is the storage quota of the account (updated with the account status)
+	QuotaLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "plexdrive_quota_limit_bytes",
+		Help: "The storage quota of the Google Drive account in bytes",
+	})
+
+	// QuotaUsage is the used storage of the account (updated with the account status)
+	QuotaUsage = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "plexdrive_quota_usage_bytes",
+		Help: "The used storage of the Google Drive account in bytes",
+	})
+
+	// BytesDownloaded counts the downloaded chunk bytes
+	BytesDownloaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "plexdrive_bytes_downloaded_total",
+		Help: "The number of bytes downloaded from Google Drive",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(APIRequests, ChunkCacheHits, ChunkCacheMisses, CacheLookups, CacheObjects, CacheBytes, QuotaLimit, QuotaUsage, BytesDownloaded)
+}
+
+// Serve starts the HTTP listener for the /metrics endpoint in the background, update is
+// called before every scrape to update the gauges that are expensive to keep current
+func Serve(address string, update func()) {
+	Log.Infof("Serving metrics on %v/metrics", address)
+
+	handler := promhttp.Handler()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		update()
+		handler.ServeHTTP(w, r)
+	})
+
+	go func() {
+		if err := http.ListenAndServe(address, mux); nil != err {
+			Log.Debugf("%v", err)
+			Log.Errorf("Could not serve metrics on %v", address)
+		}
+	}()
+}
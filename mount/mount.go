@@ -1,7 +1,9 @@
 package mount
 
 import (
+	"errors"
 	"os"
+	"syscall"
 
 	"fmt"
 
@@ -155,6 +157,8 @@ type Object struct {
 	uid          uint32
 	gid          uint32
 	umask        os.FileMode
+	// upload is the handle of a new file while it is written
+	upload *UploadHandle
 }
 
 // Attr returns the attributes for a directory
@@ -178,9 +182,9 @@ func (o *Object) Attr(ctx context.Context, attr *fuse.Attr) error {
 	attr.Uid = uint32(o.uid)
 	attr.Gid = uint32(o.gid)
 
-	attr.Mtime = o.object.LastModified
-	attr.Crtime = o.object.LastModified
-	attr.Ctime = o.object.LastModified
+	attr.Mtime = o.object.GetMTime()
+	attr.Crtime = attr.Mtime
+	attr.Ctime = attr.Mtime
 
 	attr.Blocks = (attr.Size + 511) / 512
 
@@ -191,8 +195,7 @@ func (o *Object) Attr(ctx context.Context, attr *fuse.Attr) error {
 func (o *Object) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	objects, err := o.client.GetObjectsByParent(o.object.ObjectID)
 	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fuse.ENOENT
+		return nil, toFuseError(err)
 	}
 
 	dirs := []fuse.Dirent{}
@@ -216,8 +219,20 @@ func (o *Object) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 func (o *Object) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	object, err := o.client.GetObjectByParentAndName(o.object.ObjectID, name)
 	if nil != err {
-		Log.Tracef("%v", err)
-		return nil, fuse.ENOENT
+		return nil, toFuseError(err)
+	}
+
+	// the export size is set before the node is shared, Attr and Read only read the object
+	if "" != object.ExportMimeType && !object.ExportSizeKnown && 0 == object.Size {
+		size, err := o.client.GetExportSize(object)
+		if errors.Is(err, drive.ErrDegraded) {
+			Log.Debugf("%v", err)
+		} else if nil != err {
+			Log.Warningf("%v", err)
+		} else {
+			object.Size = size
+			object.ExportSizeKnown = true
+		}
 	}
 
 	return &Object{
@@ -232,16 +247,18 @@ func (o *Object) Lookup(ctx context.Context, name string) (fs.Node, error) {
 
 // Read reads some bytes or the whole file
 func (o *Object) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	response := make(chan chunk.Response)
-	o.chunkManager.GetChunk(o.object, req.Offset, int64(req.Size), response)
-	res := <-response
-
-	if nil != res.Error {
-		Log.Warningf("%v", res.Error)
+	data := make([]byte, req.Size)
+	n, err := o.chunkManager.ReadAt(ctx, o.object, data, req.Offset)
+	if nil != err {
+		if nil != ctx.Err() {
+			Log.Debugf("Read of %v (%v) aborted", o.object.ObjectID, o.object.Name)
+			return fuse.EINTR
+		}
+		Log.Warningf("%v", err)
 		return fuse.EIO
 	}
 
-	resp.Data = res.Bytes
+	resp.Data = data[:n]
 	return nil
 }
 
@@ -249,14 +266,12 @@ func (o *Object) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.Rea
 func (o *Object) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	obj, err := o.client.GetObjectByParentAndName(o.object.ObjectID, req.Name)
 	if nil != err {
-		Log.Warningf("%v", err)
-		return fuse.EIO
+		return toFuseError(err)
 	}
 
 	err = o.client.Remove(obj, o.object.ObjectID)
 	if nil != err {
-		Log.Warningf("%v", err)
-		return fuse.EIO
+		return toFuseError(err)
 	}
 
 	return nil
@@ -266,16 +281,16 @@ func (o *Object) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 func (o *Object) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
 	newObj, err := o.client.Mkdir(o.object.ObjectID, req.Name)
 	if nil != err {
-		Log.Warningf("%v", err)
-		return nil, fuse.EIO
+		return nil, toFuseError(err)
 	}
 
 	return &Object{
-		client: o.client,
-		object: newObj,
-		uid:    o.uid,
-		gid:    o.gid,
-		umask:  o.umask,
+		client:       o.client,
+		chunkManager: o.chunkManager,
+		object:       newObj,
+		uid:          o.uid,
+		gid:          o.gid,
+		umask:        o.umask,
 	}, nil
 }
 
@@ -283,8 +298,7 @@ func (o *Object) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, er
 func (o *Object) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
 	obj, err := o.client.GetObjectByParentAndName(o.object.ObjectID, req.OldName)
 	if nil != err {
-		Log.Warningf("%v", err)
-		return fuse.EIO
+		return toFuseError(err)
 	}
 
 	destDir, ok := newDir.(*Object)
@@ -295,9 +309,27 @@ func (o *Object) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.
 
 	err = o.client.Rename(obj, o.object.ObjectID, destDir.object.ObjectID, req.NewName)
 	if nil != err {
-		Log.Warningf("%v", err)
-		return fuse.EIO
+		return toFuseError(err)
 	}
 
 	return nil
 }
+
+// toFuseError maps not found errors to ENOENT, moves between drives to EXDEV
+// (so that mv falls back to copying), writes in read only mode to EROFS and all other errors to EIO
+func toFuseError(err error) error {
+	if errors.Is(err, drive.ErrNotFound) {
+		Log.Tracef("%v", err)
+		return fuse.ENOENT
+	}
+	if errors.Is(err, drive.ErrCrossDriveMove) {
+		Log.Infof("%v", err)
+		return fuse.Errno(syscall.EXDEV)
+	}
+	if errors.Is(err, drive.ErrReadOnly) {
+		Log.Debugf("%v", err)
+		return fuse.Errno(syscall.EROFS)
+	}
+	Log.Warningf("%v", err)
+	return fuse.EIO
+}
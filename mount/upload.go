@@ -0,0 +1,139 @@
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	. "github.com/claudetech/loggo/default"
+	"github.com/dweidenfeld/plexdrive/drive"
+	"golang.org/x/net/context"
+)
+
+// UploadHandle buffers the content of a new file in a temporary file and uploads it to Google
+// Drive when the file is flushed (on close, so that the writing program sees a failed upload)
+type UploadHandle struct {
+	node   *Object
+	parent string
+	file   *os.File
+	lock   sync.Mutex
+	// dirty is set when data has been written since the last upload
+	dirty bool
+	// uploaded is the file in Google Drive once the content has been uploaded
+	uploaded *drive.APIObject
+}
+
+// Create creates a new file which is uploaded after it has been written
+func (o *Object) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if o.client.IsReadOnly() {
+		return nil, nil, fuse.Errno(syscall.EROFS)
+	}
+
+	file, err := ioutil.TempFile("", "plexdrive-upload")
+	if nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not create temporary upload file for %v", req.Name)
+		return nil, nil, fuse.EIO
+	}
+
+	node := &Object{
+		client:       o.client,
+		chunkManager: o.chunkManager,
+		object: &drive.APIObject{
+			Name:    req.Name,
+			Parents: []string{o.object.ObjectID},
+		},
+		uid:   o.uid,
+		gid:   o.gid,
+		umask: o.umask,
+	}
+
+	handle := &UploadHandle{
+		node:   node,
+		parent: o.object.ObjectID,
+		file:   file,
+		dirty:  true,
+	}
+	node.upload = handle
+	return node, handle, nil
+}
+
+// Write writes the data to the temporary upload file
+func (h *UploadHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.dirty = true
+	n, err := h.file.WriteAt(req.Data, req.Offset)
+	if nil != err {
+		Log.Warningf("%v", err)
+		return fuse.EIO
+	}
+	resp.Size = n
+
+	if size := uint64(req.Offset) + uint64(n); size > h.node.object.Size {
+		h.node.object.Size = size
+	}
+	return nil
+}
+
+// Flush uploads the written content, it is called for every close of the file so the error
+// is returned to the writing program
+func (h *UploadHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return h.sync()
+}
+
+// Release deletes the temporary file (the content has been uploaded by Flush)
+func (h *UploadHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.lock.Lock()
+	dirty := h.dirty
+	h.lock.Unlock()
+	if dirty {
+		// the file is only released without flush when the writing program has been killed
+		if err := h.sync(); nil != err {
+			Log.Warningf("Could not upload %v after it has been released", h.node.object.Name)
+		}
+	}
+
+	h.file.Close()
+	os.Remove(h.file.Name())
+	return nil
+}
+
+// Fsync uploads the written content of a new file, fsync is sent to the node instead of the handle
+func (o *Object) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	if nil == o.upload {
+		return nil
+	}
+	return o.upload.sync()
+}
+
+// sync uploads the content when data has been written since the last upload, the first upload
+// creates the file and later uploads replace its content
+func (h *UploadHandle) sync() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.dirty {
+		return nil
+	}
+
+	var object *drive.APIObject
+	var err error
+	if nil == h.uploaded {
+		object, err = h.node.client.CreateFile(h.parent, h.node.object.Name, h.file)
+	} else {
+		object, err = h.node.client.UpdateFileContent(h.uploaded, h.file)
+	}
+	if nil != err {
+		Log.Warningf("%v", err)
+		return fuse.EIO
+	}
+	h.uploaded = object
+	h.dirty = false
+	h.node.object = object
+
+	return nil
+}